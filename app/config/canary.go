@@ -0,0 +1,67 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// CanaryPolicy rolls a pushed image out to a canary first and only
+// promotes it to the mapped deployment when the canary stays healthy for
+// the bake time. Anything else aborts the change and reverts the canary.
+type CanaryPolicy struct {
+	// Deployment is an existing canary deployment, usually selected by the
+	// same service. When it is empty a temporary copy of the mapped
+	// deployment is created for the bake and removed afterwards.
+	Deployment string `json:"deployment"`
+	// Replicas of the temporary copy. When zero, Percent of the mapped
+	// deployment's replicas is used, rounded up; one replica if both are
+	// zero.
+	Replicas int32 `json:"replicas"`
+	Percent  int32 `json:"percent"`
+	// Bake is a Go duration; DefaultCanaryBake is used when empty.
+	Bake string `json:"bake"`
+	// MaxRestarts is how many container restarts the canary pods may add
+	// during the bake.
+	MaxRestarts int32 `json:"maxRestarts"`
+	// ErrorPattern is a regular expression counted in the canary logs
+	// during the bake; more than MaxErrors matching lines abort.
+	ErrorPattern string `json:"errorPattern"`
+	MaxErrors    int    `json:"maxErrors"`
+}
+
+const DefaultCanaryBake = 5 * time.Minute
+
+func (p CanaryPolicy) BakeDuration() time.Duration {
+	if d, err := time.ParseDuration(p.Bake); err == nil && d > 0 {
+		return d
+	}
+	return DefaultCanaryBake
+}
+
+// CanaryReplicas returns how many replicas a temporary canary of a
+// deployment with replicas replicas gets.
+func (p CanaryPolicy) CanaryReplicas(replicas int32) int32 {
+	if p.Replicas > 0 {
+		return p.Replicas
+	}
+	if canary := (replicas*p.Percent + 99) / 100; canary > 0 {
+		return canary
+	}
+	return 1
+}
+
+func (p CanaryPolicy) validate() error {
+	if p.Bake != "" {
+		if _, err := time.ParseDuration(p.Bake); err != nil {
+			return err
+		}
+	}
+	if p.Percent < 0 || p.Percent > 100 {
+		return fmt.Errorf("percent must be between 0 and 100")
+	}
+	if _, err := regexp.Compile(p.ErrorPattern); err != nil {
+		return err
+	}
+	return nil
+}
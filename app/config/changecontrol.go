@@ -0,0 +1,131 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChangeControl holds back webhook deploys to a namespace, or to a single
+// deployment of it, during freeze windows or until they are approved.
+type ChangeControl struct {
+	Namespace string `json:"namespace"`
+	// Deployment narrows the rule to one deployment; a deployment rule
+	// wins over the rule of its namespace.
+	Deployment string `json:"deployment"`
+	// TimeZone is an IANA name such as "Africa/Addis_Ababa"; UTC if empty.
+	TimeZone string         `json:"timeZone"`
+	Freezes  []FreezeWindow `json:"freezes"`
+	// Calendars names entries of Config.Calendars whose days are frozen.
+	Calendars       []string `json:"calendars"`
+	RequireApproval bool     `json:"requireApproval"`
+}
+
+// FreezeWindow is a weekly window such as "Fri 16:00" to "Mon 08:00".
+type FreezeWindow struct {
+	Name  string `json:"name"`
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// CalendarDateLayout is the format of the days listed in Config.Calendars.
+const CalendarDateLayout = "2006-01-02"
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ParseWeekTime parses "Fri 16:00" into the offset from Sunday 00:00.
+func ParseWeekTime(s string) (time.Duration, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return 0, fmt.Errorf("%q is not of the form \"Fri 16:00\"", s)
+	}
+
+	day, ok := weekdays[strings.ToLower(fields[0])[:min(3, len(fields[0]))]]
+	if !ok {
+		return 0, fmt.Errorf("%q has an unknown weekday", s)
+	}
+
+	clock := strings.SplitN(fields[1], ":", 2)
+	if len(clock) != 2 {
+		return 0, fmt.Errorf("%q has no hh:mm time", s)
+	}
+	hour, err := strconv.Atoi(clock[0])
+	if err != nil || hour < 0 || hour > 23 {
+		return 0, fmt.Errorf("%q has an invalid hour", s)
+	}
+	minute, err := strconv.Atoi(clock[1])
+	if err != nil || minute < 0 || minute > 59 {
+		return 0, fmt.Errorf("%q has an invalid minute", s)
+	}
+
+	return time.Duration(day)*24*time.Hour + time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute, nil
+}
+
+// Location returns the time zone of the rule.
+func (cc ChangeControl) Location() *time.Location {
+	location, err := time.LoadLocation(cc.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+// ChangeControlFor returns the rule for a deployment, or nil if its deploys
+// are not controlled.
+func (c *Config) ChangeControlFor(namespace, deployment string) *ChangeControl {
+	var namespaceRule *ChangeControl
+	for i := range c.ChangeControl {
+		rule := &c.ChangeControl[i]
+		if rule.Namespace != namespace {
+			continue
+		}
+		if rule.Deployment == deployment {
+			return rule
+		}
+		if rule.Deployment == "" && namespaceRule == nil {
+			namespaceRule = rule
+		}
+	}
+	return namespaceRule
+}
+
+func (cc ChangeControl) validate(calendars map[string][]string) error {
+	if cc.Namespace == "" {
+		return fmt.Errorf("namespace is required")
+	}
+	if _, err := time.LoadLocation(cc.TimeZone); err != nil {
+		return err
+	}
+
+	for i, freeze := range cc.Freezes {
+		if _, err := ParseWeekTime(freeze.Start); err != nil {
+			return fmt.Errorf("freezes[%d].start: %w", i, err)
+		}
+		if _, err := ParseWeekTime(freeze.End); err != nil {
+			return fmt.Errorf("freezes[%d].end: %w", i, err)
+		}
+	}
+
+	for _, name := range cc.Calendars {
+		if _, ok := calendars[name]; !ok {
+			return fmt.Errorf("unknown calendar %q", name)
+		}
+	}
+
+	return nil
+}
+
+func validateCalendars(calendars map[string][]string) error {
+	for name, dates := range calendars {
+		for _, date := range dates {
+			if _, err := time.Parse(CalendarDateLayout, date); err != nil {
+				return fmt.Errorf("calendar %q: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
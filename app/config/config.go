@@ -0,0 +1,257 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"time"
+
+	"github.com/chechetech/app/azure-go/repositories/semver"
+)
+
+// Config holds the deployment settings that can't be derived from the
+// cluster itself. It is read once at start-up from the JSON file named by
+// APP_CONFIG; without that file every field keeps its zero value and the
+// webhook falls back to the repository naming convention.
+type Config struct {
+	// DefaultTagPolicy applies to repositories without a mapping.
+	DefaultTagPolicy TagPolicy `json:"defaultTagPolicy"`
+	// DefaultImageRef applies to repositories without a mapping.
+	DefaultImageRef string `json:"defaultImageRef"`
+	// DefaultRollout applies to repositories without a mapping.
+	DefaultRollout RolloutPolicy   `json:"defaultRollout"`
+	Mappings       []Mapping       `json:"mappings"`
+	ChangeControl  []ChangeControl `json:"changeControl"`
+	// Calendars maps a calendar name to the days (2006-01-02) it freezes.
+	Calendars     map[string][]string `json:"calendars"`
+	Notifications []Notification      `json:"notifications"`
+	// Environments are the names that appear as a segment of repository
+	// paths, like prod in siyaha/temariko/prod/web. Promotions swap that
+	// segment; DefaultEnvironments is used when empty.
+	Environments []string   `json:"environments"`
+	Registries   []Registry `json:"registries"`
+}
+
+var DefaultEnvironments = []string{"dev", "test", "staging", "prod"}
+
+// EnvironmentNames returns the configured environments or the defaults.
+func (c *Config) EnvironmentNames() []string {
+	if len(c.Environments) > 0 {
+		return c.Environments
+	}
+	return DefaultEnvironments
+}
+
+// Mapping routes pushes to a repository to a container of a deployment.
+type Mapping struct {
+	// Repository is matched with path.Match, so "siyaha/*/prod/web" works.
+	Repository string    `json:"repository"`
+	Namespace  string    `json:"namespace"`
+	Deployment string    `json:"deployment"`
+	Container  string    `json:"container"`
+	TagPolicy  TagPolicy `json:"tagPolicy"`
+	// ImageRef is one of the ImageRef* constants and decides how the
+	// pushed image is written into the pod template.
+	ImageRef string        `json:"imageRef"`
+	Rollout  RolloutPolicy `json:"rollout"`
+	// Canary opts the repository in to canary rollouts.
+	Canary *CanaryPolicy `json:"canary"`
+}
+
+// RolloutPolicy controls what happens after the image has been patched.
+type RolloutPolicy struct {
+	// Wait watches the rollout until it completes, fails or times out.
+	Wait bool `json:"wait"`
+	// Timeout is a Go duration; DefaultRolloutTimeout is used when empty.
+	Timeout string `json:"timeout"`
+	// Rollback restores the previous ReplicaSet template when the rollout
+	// fails. It has no effect without Wait.
+	Rollback bool `json:"rollback"`
+}
+
+const DefaultRolloutTimeout = 5 * time.Minute
+
+func (p RolloutPolicy) TimeoutDuration() time.Duration {
+	if d, err := time.ParseDuration(p.Timeout); err == nil && d > 0 {
+		return d
+	}
+	return DefaultRolloutTimeout
+}
+
+const (
+	// ImageRefTag deploys host/repo:tag, the default.
+	ImageRefTag = "tag"
+	// ImageRefDigest deploys host/repo@sha256:..., pinned to the push.
+	ImageRefDigest = "digest"
+	// ImageRefTagDigest deploys host/repo:tag@sha256:..., pinned but
+	// still readable.
+	ImageRefTagDigest = "tagDigest"
+)
+
+// TagPolicy decides which registry events are allowed to deploy.
+type TagPolicy struct {
+	// Actions lists the webhook actions to act on; empty means "push" only.
+	Actions []string `json:"actions"`
+	// Semver is a range such as ">=1.2.0 <2.0.0" or "^1.4"; tags that are
+	// not semantic versions are rejected when it is set.
+	Semver string   `json:"semver"`
+	Allow  []string `json:"allow"`
+	Deny   []string `json:"deny"`
+	// OnlyNewer rejects tags that are not greater than the running tag.
+	OnlyNewer bool `json:"onlyNewer"`
+}
+
+func Load(filename string) (*Config, error) {
+	cfg := &Config{}
+	if filename == "" {
+		return cfg, nil
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	return cfg, nil
+}
+
+// MappingFor returns the first mapping whose pattern matches repository.
+func (c *Config) MappingFor(repository string) *Mapping {
+	for i := range c.Mappings {
+		if ok, _ := path.Match(c.Mappings[i].Repository, repository); ok {
+			return &c.Mappings[i]
+		}
+	}
+	return nil
+}
+
+// TagPolicyFor returns the policy of mapping, or the default one if nil.
+func (c *Config) TagPolicyFor(mapping *Mapping) TagPolicy {
+	if mapping != nil {
+		return mapping.TagPolicy
+	}
+	return c.DefaultTagPolicy
+}
+
+// ImageRefFor returns the image reference mode of mapping, or the default
+// one if nil.
+func (c *Config) ImageRefFor(mapping *Mapping) string {
+	ref := c.DefaultImageRef
+	if mapping != nil && mapping.ImageRef != "" {
+		ref = mapping.ImageRef
+	}
+	if ref == "" {
+		return ImageRefTag
+	}
+	return ref
+}
+
+// RolloutPolicyFor returns the rollout policy of mapping, or the default
+// one if nil.
+func (c *Config) RolloutPolicyFor(mapping *Mapping) RolloutPolicy {
+	if mapping != nil {
+		return mapping.Rollout
+	}
+	return c.DefaultRollout
+}
+
+func (c *Config) validate() error {
+	if err := c.DefaultTagPolicy.validate(); err != nil {
+		return fmt.Errorf("defaultTagPolicy: %w", err)
+	}
+	if err := validateImageRef(c.DefaultImageRef); err != nil {
+		return fmt.Errorf("defaultImageRef: %w", err)
+	}
+	if err := c.DefaultRollout.validate(); err != nil {
+		return fmt.Errorf("defaultRollout: %w", err)
+	}
+
+	if err := validateCalendars(c.Calendars); err != nil {
+		return err
+	}
+	for i, rule := range c.ChangeControl {
+		if err := rule.validate(c.Calendars); err != nil {
+			return fmt.Errorf("changeControl[%d]: %w", i, err)
+		}
+	}
+
+	if err := validateRegistries(c.Registries); err != nil {
+		return err
+	}
+
+	for i, notification := range c.Notifications {
+		if err := notification.validate(); err != nil {
+			return fmt.Errorf("notifications[%d]: %w", i, err)
+		}
+	}
+
+	for i, mapping := range c.Mappings {
+		if mapping.Repository == "" {
+			return fmt.Errorf("mappings[%d]: repository is required", i)
+		}
+		if _, err := path.Match(mapping.Repository, ""); err != nil {
+			return fmt.Errorf("mappings[%d]: %w", i, err)
+		}
+		if mapping.Namespace == "" || mapping.Deployment == "" {
+			return fmt.Errorf("mappings[%d]: namespace and deployment are required", i)
+		}
+		if err := mapping.TagPolicy.validate(); err != nil {
+			return fmt.Errorf("mappings[%d].tagPolicy: %w", i, err)
+		}
+		if err := validateImageRef(mapping.ImageRef); err != nil {
+			return fmt.Errorf("mappings[%d].imageRef: %w", i, err)
+		}
+		if err := mapping.Rollout.validate(); err != nil {
+			return fmt.Errorf("mappings[%d].rollout: %w", i, err)
+		}
+		if mapping.Canary != nil {
+			if err := mapping.Canary.validate(); err != nil {
+				return fmt.Errorf("mappings[%d].canary: %w", i, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p TagPolicy) validate() error {
+	for _, pattern := range append(append([]string{}, p.Allow...), p.Deny...) {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return err
+		}
+	}
+	if p.Semver != "" {
+		if _, err := semver.ParseRange(p.Semver); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateImageRef(ref string) error {
+	switch ref {
+	case "", ImageRefTag, ImageRefDigest, ImageRefTagDigest:
+		return nil
+	}
+	return fmt.Errorf("unknown image reference mode %q", ref)
+}
+
+func (p RolloutPolicy) validate() error {
+	if p.Timeout == "" {
+		return nil
+	}
+	if _, err := time.ParseDuration(p.Timeout); err != nil {
+		return err
+	}
+	return nil
+}
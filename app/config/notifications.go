@@ -0,0 +1,105 @@
+package config
+
+import (
+	"fmt"
+	"text/template"
+)
+
+const (
+	// NotifySlack posts {"text": message} to a Slack incoming webhook.
+	NotifySlack = "slack"
+	// NotifyTeams posts {"text": message} to a Teams incoming webhook.
+	NotifyTeams = "teams"
+	// NotifyWebhook posts the event and the message as JSON.
+	NotifyWebhook = "webhook"
+	// NotifyEmail sends the message over SMTP.
+	NotifyEmail = "email"
+)
+
+const (
+	EventDeployed   = "deployed"
+	EventFailed     = "failed"
+	EventRolledBack = "rolledBack"
+)
+
+// Notification is a sink that is told when an image change is deployed,
+// fails or is rolled back.
+type Notification struct {
+	Name string `json:"name"`
+	// Type is one of the Notify* constants.
+	Type string `json:"type"`
+	// URL is where slack, teams and webhook sinks post to.
+	URL string `json:"url"`
+	// Namespaces limits the sink to these namespaces; empty means all.
+	Namespaces []string `json:"namespaces"`
+	// Events lists the Event* constants to send; empty means all.
+	Events []string `json:"events"`
+	// Template is a text/template executed with the event; a default
+	// message is used when it is empty.
+	Template string `json:"template"`
+	Email    *Email `json:"email"`
+}
+
+// Email is the SMTP server and recipients of an email sink. The password
+// is read from the environment so it can stay out of the config file.
+type Email struct {
+	Host        string   `json:"host"`
+	Port        int      `json:"port"`
+	Username    string   `json:"username"`
+	PasswordEnv string   `json:"passwordEnv"`
+	From        string   `json:"from"`
+	To          []string `json:"to"`
+}
+
+// NotificationsFor returns the sinks that want event for namespace.
+func (c *Config) NotificationsFor(namespace, event string) []Notification {
+	var sinks []Notification
+	for _, notification := range c.Notifications {
+		if matches(notification.Namespaces, namespace) && matches(notification.Events, event) {
+			sinks = append(sinks, notification)
+		}
+	}
+	return sinks
+}
+
+// matches reports whether value is in list, treating an empty list as
+// matching everything.
+func matches(list []string, value string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (n Notification) validate() error {
+	switch n.Type {
+	case NotifySlack, NotifyTeams, NotifyWebhook:
+		if n.URL == "" {
+			return fmt.Errorf("url is required for %s", n.Type)
+		}
+	case NotifyEmail:
+		if n.Email == nil || n.Email.Host == "" || n.Email.From == "" || len(n.Email.To) == 0 {
+			return fmt.Errorf("email.host, email.from and email.to are required")
+		}
+	default:
+		return fmt.Errorf("unknown notification type %q", n.Type)
+	}
+
+	for _, event := range n.Events {
+		switch event {
+		case EventDeployed, EventFailed, EventRolledBack:
+		default:
+			return fmt.Errorf("unknown event %q", event)
+		}
+	}
+
+	if _, err := template.New(n.Name).Parse(n.Template); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// Registry is a container registry whose repositories and tags can be
+// browsed through the OCI Distribution API.
+type Registry struct {
+	Name string `json:"name"`
+	// Host is how images of the registry are referenced, such as
+	// anansi.azurecr.io or ghcr.io.
+	Host string `json:"host"`
+	// URL is where the API is served; https://<host> when empty. A local
+	// registry:2 would be http://localhost:5000.
+	URL      string `json:"url"`
+	Username string `json:"username"`
+	// PasswordEnv names the environment variable holding the password or
+	// token, so it can stay out of the config file.
+	PasswordEnv string `json:"passwordEnv"`
+}
+
+// BaseURL returns URL, or the https URL of Host when it is empty.
+func (r Registry) BaseURL() string {
+	if r.URL != "" {
+		return r.URL
+	}
+	return "https://" + r.Host
+}
+
+// RegistryNamed returns the registry called name, or nil.
+func (c *Config) RegistryNamed(name string) *Registry {
+	for i := range c.Registries {
+		if c.Registries[i].Name == name {
+			return &c.Registries[i]
+		}
+	}
+	return nil
+}
+
+// RegistryHost returns the registry serving images of host, or nil.
+func (c *Config) RegistryHost(host string) *Registry {
+	for i := range c.Registries {
+		if c.Registries[i].Host == host {
+			return &c.Registries[i]
+		}
+	}
+	return nil
+}
+
+func validateRegistries(registries []Registry) error {
+	names := map[string]bool{}
+	for i, registry := range registries {
+		if registry.Name == "" || registry.Host == "" {
+			return fmt.Errorf("registries[%d]: name and host are required", i)
+		}
+		if names[registry.Name] {
+			return fmt.Errorf("registries[%d]: duplicate name %q", i, registry.Name)
+		}
+		names[registry.Name] = true
+		if _, err := url.Parse(registry.BaseURL()); err != nil {
+			return fmt.Errorf("registries[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
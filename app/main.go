@@ -1,12 +1,30 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	// The runtime image has no zoneinfo for change control time zones.
+	_ "time/tzdata"
 
+	"github.com/chechetech/app/azure-go/config"
 	Middlewares "github.com/chechetech/app/azure-go/middlewares"
+	"github.com/chechetech/app/azure-go/repositories/cache"
+	"github.com/chechetech/app/azure-go/repositories/changes"
+	"github.com/chechetech/app/azure-go/repositories/deployments"
+	"github.com/chechetech/app/azure-go/repositories/history"
+	"github.com/chechetech/app/azure-go/repositories/notifications"
+	"github.com/chechetech/app/azure-go/repositories/pods"
+	"github.com/chechetech/app/azure-go/repositories/webhooks"
 	Routes "github.com/chechetech/app/azure-go/routes"
 
 	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
 )
 
 func main() {
@@ -18,15 +36,96 @@ func main() {
 		log.Fatalf("Failed to get client set: %v", err)
 	}
 
+	cfg, err := config.Load(os.Getenv("APP_CONFIG"))
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+
+	dbPath := os.Getenv("APP_DB_PATH")
+	if dbPath == "" {
+		dbPath = "dashboard.db"
+	}
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	historyStore, err := history.New(db)
+	if err != nil {
+		log.Fatalf("Failed to open history: %v", err)
+	}
+
+	rollouts := deployments.NewRolloutTracker(20)
+	notifier := notifications.New(cfg)
+
+	changeManager, err := changes.NewManager(db, clientset, cfg, historyStore, rollouts, notifier)
+	if err != nil {
+		log.Fatalf("Failed to open changes: %v", err)
+	}
+
+	webhookQueue, err := webhooks.NewQueue(db)
+	if err != nil {
+		log.Fatalf("Failed to open webhook queue: %v", err)
+	}
+	changeManager.OnUpdate(webhookQueue.Settle)
+	go changeManager.Run(context.Background(), 30*time.Second)
+	processor := webhooks.NewProcessor(clientset, cfg, changeManager)
+	go webhookQueue.Run(context.Background(), 4, processor.Process)
+
+	store := cache.New(clientset)
+	defer store.Stop()
+	podWatcher := pods.NewWatcher(store)
+
 	r := gin.Default()
 	r.Use(Middlewares.SetClient(clientset))
+	r.Use(Middlewares.SetConfig(cfg))
+	r.Use(Middlewares.SetRollouts(rollouts))
+	r.Use(Middlewares.SetHistory(historyStore))
+	r.Use(Middlewares.SetChanges(changeManager))
+	r.Use(Middlewares.SetWebhooks(webhookQueue))
+	r.Use(Middlewares.SetNotifier(notifier))
+	r.Use(Middlewares.SetCache(store))
+	r.Use(Middlewares.SetPodWatcher(podWatcher))
+
+	// Probes don't carry a token.
+	Routes.RegisterHealthRoutes(r)
+
 	r.Use(Middlewares.ValidateToken())
 
 	Routes.RegisterPodsRoutes(r)
+	Routes.RegisterDeploymentsRoutes(r)
+	Routes.RegisterLogsRoutes(r)
+	Routes.RegisterChangesRoutes(r)
+	Routes.RegisterPromotionsRoutes(r)
+	Routes.RegisterCacheRoutes(r)
 
 	// Register RegistriesRoutes without ValidateToken middleware
 	Routes.RegisterRegistriesRoutes(r)
 
+	// On a signal the server stops taking requests and the informers of
+	// the cache are stopped before the process exits.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	server := &http.Server{Addr: ":5000", Handler: r}
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Failed to shut down server: %v", err)
+		}
+	}()
+
 	log.Println("Starting server v1")
-	r.Run(":5000")
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Printf("Server failed: %v", err)
+		stop()
+	}
+	// Requests in flight get to finish first.
+	<-shutdown
+	log.Println("Server stopped")
 }
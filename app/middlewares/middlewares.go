@@ -1,12 +1,22 @@
 package middlewares
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/chechetech/app/azure-go/config"
+	"github.com/chechetech/app/azure-go/repositories/cache"
+	"github.com/chechetech/app/azure-go/repositories/changes"
+	"github.com/chechetech/app/azure-go/repositories/deployments"
+	"github.com/chechetech/app/azure-go/repositories/history"
+	"github.com/chechetech/app/azure-go/repositories/notifications"
+	"github.com/chechetech/app/azure-go/repositories/pods"
+	"github.com/chechetech/app/azure-go/repositories/webhooks"
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
 	"k8s.io/client-go/kubernetes"
@@ -41,6 +51,62 @@ func SetClient(clientset *kubernetes.Clientset) gin.HandlerFunc {
 	}
 }
 
+func SetConfig(cfg *config.Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("config", cfg)
+		c.Next()
+	}
+}
+
+func SetRollouts(rollouts *deployments.RolloutTracker) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("rollouts", rollouts)
+		c.Next()
+	}
+}
+
+func SetHistory(store *history.Store) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("history", store)
+		c.Next()
+	}
+}
+
+func SetChanges(manager *changes.Manager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("changes", manager)
+		c.Next()
+	}
+}
+
+func SetWebhooks(queue *webhooks.Queue) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("webhooks", queue)
+		c.Next()
+	}
+}
+
+func SetNotifier(notifier *notifications.Notifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("notifier", notifier)
+		c.Next()
+	}
+}
+
+func SetCache(store *cache.Cache) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("cache", store)
+		c.Next()
+	}
+}
+
+func SetPodWatcher(watcher *pods.Watcher) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("podWatcher", watcher)
+		c.Next()
+	}
+}
+
 func GenerateToken() (string, error) {
 	secret := os.Getenv("APP_AUTH_TOKEN")
 	if secret == "" {
@@ -88,6 +154,7 @@ func ValidateToken() gin.HandlerFunc {
 		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
 			if namespace, ok := claims["namespace"].(string); ok {
 				c.Set("namespace", namespace)
+				c.Set("actor", actor(claims, tokenString))
 			} else {
 				abortWithError(c, 401, "Invalid token claims")
 				return
@@ -101,6 +168,17 @@ func ValidateToken() gin.HandlerFunc {
 	}
 }
 
+// actor names who made a request for the audit history: the token's subject
+// when it has one, otherwise a fingerprint that identifies the token without
+// revealing it.
+func actor(claims jwt.MapClaims, tokenString string) string {
+	if subject, ok := claims["sub"].(string); ok && subject != "" {
+		return subject
+	}
+	sum := sha256.Sum256([]byte(tokenString))
+	return "token:" + hex.EncodeToString(sum[:6])
+}
+
 func abortWithError(c *gin.Context, code int, message string) {
 	c.JSON(code, gin.H{"error": message})
 	c.Abort()
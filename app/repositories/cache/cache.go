@@ -0,0 +1,168 @@
+package cache
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	toolscache "k8s.io/client-go/tools/cache"
+)
+
+// Cache keeps pods, deployments, ReplicaSets and events in memory through
+// shared informers, so reads don't each go to the API server. Namespaces
+// are only watched once a request reads them, which keeps the cache to the
+// namespaces the tokens in use are for. They are watched until Stop.
+//
+// The listers return nil, false until their namespace has synced, and a nil
+// Cache never has anything; callers read from the API server then. Objects
+// from the listers are shared and must not be modified.
+type Cache struct {
+	clientSet *kubernetes.Clientset
+	stop      chan struct{}
+
+	mu         sync.Mutex
+	namespaces map[string]*namespaceCache
+}
+
+type namespaceCache struct {
+	factory   informers.SharedInformerFactory
+	informers map[string]toolscache.SharedIndexInformer
+	startedAt time.Time
+}
+
+// Status is how far the cache of a namespace has synced, by resource.
+type Status struct {
+	Namespace string          `json:"namespace"`
+	StartedAt time.Time       `json:"startedAt"`
+	Synced    map[string]bool `json:"synced"`
+}
+
+// Ready reports whether every resource of the namespace has synced.
+func (s Status) Ready() bool {
+	for _, synced := range s.Synced {
+		if !synced {
+			return false
+		}
+	}
+	return true
+}
+
+func New(clientSet *kubernetes.Clientset) *Cache {
+	return &Cache{
+		clientSet:  clientSet,
+		stop:       make(chan struct{}),
+		namespaces: map[string]*namespaceCache{},
+	}
+}
+
+// Stop stops the informers of every namespace and waits for them to end.
+// The cache must not be read afterwards.
+func (c *Cache) Stop() {
+	close(c.stop)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, nc := range c.namespaces {
+		nc.factory.Shutdown()
+	}
+}
+
+// PodInformer returns the pod informer of namespace for callers that want
+// its events.
+func (c *Cache) PodInformer(namespace string) toolscache.SharedIndexInformer {
+	return c.namespace(namespace).informers["pods"]
+}
+
+func (c *Cache) Pods(namespace string) (corelisters.PodNamespaceLister, bool) {
+	if c == nil {
+		return nil, false
+	}
+	nc := c.namespace(namespace)
+	return nc.factory.Core().V1().Pods().Lister().Pods(namespace), nc.informers["pods"].HasSynced()
+}
+
+func (c *Cache) Deployments(namespace string) (appslisters.DeploymentNamespaceLister, bool) {
+	if c == nil {
+		return nil, false
+	}
+	nc := c.namespace(namespace)
+	return nc.factory.Apps().V1().Deployments().Lister().Deployments(namespace), nc.informers["deployments"].HasSynced()
+}
+
+func (c *Cache) ReplicaSets(namespace string) (appslisters.ReplicaSetNamespaceLister, bool) {
+	if c == nil {
+		return nil, false
+	}
+	nc := c.namespace(namespace)
+	return nc.factory.Apps().V1().ReplicaSets().Lister().ReplicaSets(namespace), nc.informers["replicaSets"].HasSynced()
+}
+
+func (c *Cache) Events(namespace string) (corelisters.EventNamespaceLister, bool) {
+	if c == nil {
+		return nil, false
+	}
+	nc := c.namespace(namespace)
+	return nc.factory.Core().V1().Events().Lister().Events(namespace), nc.informers["events"].HasSynced()
+}
+
+// NamespaceStatus reports the sync state of namespace, and false if it
+// isn't watched yet. Unlike the listers it doesn't start watching it.
+func (c *Cache) NamespaceStatus(namespace string) (Status, bool) {
+	status := Status{Namespace: namespace, Synced: map[string]bool{}}
+	if c == nil {
+		return status, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	nc, ok := c.namespaces[namespace]
+	if !ok {
+		return status, false
+	}
+	status.StartedAt = nc.startedAt
+	for resource, informer := range nc.informers {
+		status.Synced[resource] = informer.HasSynced()
+	}
+	return status, true
+}
+
+// namespace returns the cache of namespace, starting its informers the
+// first time.
+func (c *Cache) namespace(namespace string) *namespaceCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if nc, ok := c.namespaces[namespace]; ok {
+		return nc
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(c.clientSet, 0, informers.WithNamespace(namespace))
+	nc := &namespaceCache{
+		factory: factory,
+		informers: map[string]toolscache.SharedIndexInformer{
+			"pods":        factory.Core().V1().Pods().Informer(),
+			"deployments": factory.Apps().V1().Deployments().Informer(),
+			"replicaSets": factory.Apps().V1().ReplicaSets().Informer(),
+			"events":      factory.Core().V1().Events().Informer(),
+		},
+		startedAt: time.Now(),
+	}
+	for _, informer := range nc.informers {
+		// Managed fields are never shown and take up much of an object.
+		informer.SetTransform(func(obj interface{}) (interface{}, error) {
+			if accessor, err := meta.Accessor(obj); err == nil {
+				accessor.SetManagedFields(nil)
+			}
+			return obj, nil
+		})
+	}
+	factory.Start(c.stop)
+
+	c.namespaces[namespace] = nc
+	return nc
+}
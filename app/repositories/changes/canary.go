@@ -0,0 +1,362 @@
+package changes
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/chechetech/app/azure-go/config"
+	"github.com/chechetech/app/azure-go/repositories/deployments"
+	"github.com/chechetech/app/azure-go/repositories/history"
+	"github.com/chechetech/app/azure-go/repositories/pods"
+	"github.com/chechetech/app/azure-go/repositories/registries"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	CanaryRollingOut = "rollingOut"
+	CanaryBaking     = "baking"
+	CanaryPromoted   = "promoted"
+	CanaryAborted    = "aborted"
+)
+
+const canaryCheckInterval = 5 * time.Second
+
+// Canary is the progress of a change that goes through a canary. It is
+// stored with the change, so a restart carries on where it left off.
+type Canary struct {
+	Deployment string `json:"deployment"`
+	// Temporary canaries were created for the change and are deleted once
+	// it is promoted or aborted.
+	Temporary bool `json:"temporary"`
+	// PreviousImage is what a named canary ran before; an abort restores
+	// it.
+	PreviousImage string     `json:"previousImage,omitempty"`
+	State         string     `json:"state"`
+	Generation    int64      `json:"generation"`
+	StartedAt     time.Time  `json:"startedAt"`
+	BakeStartedAt *time.Time `json:"bakeStartedAt,omitempty"`
+	BakeUntil     *time.Time `json:"bakeUntil,omitempty"`
+	// BaselineRestarts is the restart count of the canary pods when the
+	// bake started; Restarts and Errors are counted from then on.
+	BaselineRestarts int32 `json:"baselineRestarts"`
+	Restarts         int32 `json:"restarts"`
+	Errors           int   `json:"errors"`
+}
+
+// release applies a change change control no longer holds back, through a
+// canary when its mapping asks for one. The caller holds the lock of the
+// deployment.
+func (m *Manager) release(change Change) (Change, error) {
+	if policy := m.canaryPolicyFor(change); policy != nil && change.Canary == nil {
+		return m.startCanary(change, policy)
+	}
+	return m.apply(change)
+}
+
+// canaryPolicyFor returns the canary policy of the mapping of change, or
+// nil when it has none.
+func (m *Manager) canaryPolicyFor(change Change) *config.CanaryPolicy {
+	if mapping := m.cfg.MappingFor(change.Repository); mapping != nil {
+		return mapping.Canary
+	}
+	return nil
+}
+
+func (m *Manager) startCanary(change Change, policy *config.CanaryPolicy) (Change, error) {
+	update := registries.ImageUpdate{
+		Container: change.Container,
+		Image:     change.Image,
+		Tag:       change.Tag,
+		Digest:    change.Digest,
+	}
+
+	canary := &Canary{Deployment: policy.Deployment, State: CanaryRollingOut, StartedAt: time.Now()}
+	change.Canary = canary
+
+	var err error
+	if policy.Deployment != "" {
+		var result registries.UpdateResult
+		result, err = m.updateImage(change.Namespace, policy.Deployment, update)
+		canary.PreviousImage, canary.Generation = result.PreviousImage, result.Generation
+	} else {
+		canary.Temporary = true
+		canary.Deployment, canary.Generation, err = deployments.CreateCanary(m.clientset, change.Namespace, change.Deployment, policy.CanaryReplicas, update)
+	}
+	if err != nil {
+		return m.abortCanary(change, fmt.Sprintf("failed to start canary: %v", err)), err
+	}
+
+	change.Status, change.Reason = StatusCanary, fmt.Sprintf("rolling out to canary %s", canary.Deployment)
+	m.storeChange(&change)
+	fmt.Printf("Change %d for %s/%s: %s\n", change.ID, change.Namespace, change.Deployment, change.Reason)
+	return change, nil
+}
+
+// advanceCanaries moves every change on a canary one step further.
+func (m *Manager) advanceCanaries() {
+	var active []Change
+	err := m.db.View(func(tx *bolt.Tx) error {
+		return eachChange(tx, func(change Change) error {
+			if change.Status == StatusCanary && change.Canary != nil {
+				active = append(active, change)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		fmt.Printf("Error reading canaries: %v\n", err)
+		return
+	}
+
+	for _, change := range active {
+		m.advanceCanary(change)
+	}
+}
+
+// What a check of a canary leads to.
+const (
+	canaryRetry = iota
+	canaryStore
+	canaryAbort
+	canaryPromote
+)
+
+// advanceCanary checks the canary of change and acts on the outcome. The
+// checks read the cluster without holding any lock; the outcome is only
+// acted on if the change is still on its canary in the state it was read
+// in, as a newer change may have superseded it meanwhile.
+func (m *Manager) advanceCanary(change Change) {
+	state := change.Canary.State
+	outcome, reason := m.checkCanary(&change)
+	if outcome == canaryRetry {
+		return
+	}
+
+	if outcome == canaryStore {
+		stored := false
+		err := m.db.Update(func(tx *bolt.Tx) error {
+			current, found, err := getChange(tx, change.ID)
+			if err != nil || !found || !current.onCanary(state) {
+				return err
+			}
+			stored = true
+			return putChange(tx, &change)
+		})
+		if err != nil {
+			fmt.Printf("Error storing change %d: %v\n", change.ID, err)
+			return
+		}
+		if stored && change.Canary.State != state {
+			m.updated(change)
+		}
+		return
+	}
+
+	unlock := m.lockTarget(change)
+	defer unlock()
+	if current, err := m.reread(change); err != nil || !current.onCanary(state) {
+		return
+	}
+
+	if outcome == canaryAbort {
+		m.abortCanary(change, reason)
+		return
+	}
+
+	canary := change.Canary
+	canary.State = CanaryPromoted
+	if canary.Temporary {
+		if err := deployments.DeleteCanary(m.clientset, change.Namespace, canary.Deployment); err != nil {
+			fmt.Printf("Error removing canary %s: %v\n", canary.Deployment, err)
+		}
+	}
+	fmt.Printf("Promoting change %d from canary %s to %s/%s\n", change.ID, canary.Deployment, change.Namespace, change.Deployment)
+	if _, err := m.apply(change); err != nil {
+		fmt.Printf("Error applying change %d: %v\n", change.ID, err)
+	}
+}
+
+// onCanary reports whether the change is on its canary in state.
+func (c Change) onCanary(state string) bool {
+	return c.Status == StatusCanary && c.Canary != nil && c.Canary.State == state
+}
+
+// checkCanary waits for the canary to roll out, then bakes it until it can
+// be promoted, or fails it as soon as it restarts or logs errors too often,
+// or if it isn't ready when the bake is over; reason says why it is
+// aborted. The progress is kept in change. Errors reading the canary's
+// state are retried on the next check.
+func (m *Manager) checkCanary(change *Change) (outcome int, reason string) {
+	canary := change.Canary
+	// The defaults apply if the mapping lost its policy since the canary
+	// started.
+	policy := config.CanaryPolicy{}
+	if mapped := m.canaryPolicyFor(*change); mapped != nil {
+		policy = *mapped
+	}
+	now := time.Now()
+
+	switch canary.State {
+	case CanaryRollingOut:
+		done, err := deployments.RolloutStatus(m.clientset, change.Namespace, canary.Deployment, canary.Generation)
+		if errors.Is(err, deployments.ErrProgressDeadlineExceeded) {
+			return canaryAbort, err.Error()
+		}
+		if err != nil {
+			fmt.Printf("Error checking canary %s: %v\n", canary.Deployment, err)
+			return canaryRetry, ""
+		}
+		if !done {
+			timeout := m.cfg.RolloutPolicyFor(m.cfg.MappingFor(change.Repository)).TimeoutDuration()
+			if now.Sub(canary.StartedAt) > timeout {
+				return canaryAbort, "canary did not roll out in time"
+			}
+			return canaryRetry, ""
+		}
+
+		health, err := deployments.GetHealth(m.clientset, change.Namespace, canary.Deployment)
+		if err != nil {
+			fmt.Printf("Error checking canary %s: %v\n", canary.Deployment, err)
+			return canaryRetry, ""
+		}
+
+		bakeUntil := now.Add(policy.BakeDuration())
+		canary.State, canary.BakeStartedAt, canary.BakeUntil = CanaryBaking, &now, &bakeUntil
+		canary.BaselineRestarts = health.Restarts
+		change.Reason = fmt.Sprintf("baking on canary %s until %s", canary.Deployment, bakeUntil.Format(time.RFC3339))
+		return canaryStore, ""
+
+	case CanaryBaking:
+		health, err := deployments.GetHealth(m.clientset, change.Namespace, canary.Deployment)
+		if err != nil {
+			fmt.Printf("Error checking canary %s: %v\n", canary.Deployment, err)
+			return canaryRetry, ""
+		}
+
+		canary.Restarts = health.Restarts - canary.BaselineRestarts
+		if canary.Restarts > policy.MaxRestarts {
+			return canaryAbort, fmt.Sprintf("canary pods restarted %d times", canary.Restarts)
+		}
+
+		if policy.ErrorPattern != "" {
+			pattern := regexp.MustCompile(policy.ErrorPattern)
+			canary.Errors = 0
+			var readErr error
+			for _, pod := range health.Pods {
+				container := change.Container
+				if container == "" && len(pod.Spec.Containers) > 0 {
+					// The image went to the first container.
+					container = pod.Spec.Containers[0].Name
+				}
+				count, err := pods.CountLogLines(m.clientset, change.Namespace, pod.Name, container, *canary.BakeStartedAt, pattern)
+				if err != nil {
+					readErr = fmt.Errorf("failed to read logs of canary pod %s: %w", pod.Name, err)
+					break
+				}
+				canary.Errors += count
+			}
+			if canary.Errors > policy.MaxErrors {
+				return canaryAbort, fmt.Sprintf("canary logged %d lines matching %q", canary.Errors, policy.ErrorPattern)
+			}
+			// Logs that couldn't be read haven't passed the check. They are
+			// read again on the next check, until the bake is over.
+			if readErr != nil {
+				if now.Before(*canary.BakeUntil) {
+					fmt.Printf("Error checking canary %s: %v\n", canary.Deployment, readErr)
+					return canaryRetry, ""
+				}
+				return canaryAbort, readErr.Error()
+			}
+		}
+
+		if now.Before(*canary.BakeUntil) {
+			return canaryStore, ""
+		}
+		// Pods go unready for a while when they restart or flap, which the
+		// restarts and errors are checked for; only a canary that isn't
+		// ready once the bake is over fails for it.
+		if len(health.Pods) == 0 || health.Ready < len(health.Pods) {
+			return canaryAbort, fmt.Sprintf("%d of %d canary pods are ready after the bake", health.Ready, len(health.Pods))
+		}
+		return canaryPromote, ""
+	}
+	return canaryRetry, ""
+}
+
+// abortCanary reverts the canary and fails the change, recording and
+// notifying it like a failed deploy of the deployment itself.
+func (m *Manager) abortCanary(change Change, reason string) Change {
+	if err := m.revertCanary(change); err != nil {
+		reason = fmt.Sprintf("%s; %v", reason, err)
+	}
+
+	change.Canary.State = CanaryAborted
+	change.Status, change.Reason = StatusFailed, "canary aborted: "+reason
+
+	entry := history.Entry{
+		Time:       change.Canary.StartedAt,
+		Action:     change.Action,
+		WebhookID:  change.WebhookID,
+		Actor:      change.Actor,
+		Namespace:  change.Namespace,
+		Deployment: change.Deployment,
+		Container:  change.Container,
+		NewImage:   change.Image,
+		Tag:        change.Tag,
+		Digest:     change.Digest,
+		Result:     history.ResultFailed,
+		Reason:     change.Reason,
+		DurationMs: time.Since(change.Canary.StartedAt).Milliseconds(),
+	}
+	if entry.Action == "" {
+		entry.Action = history.ActionWebhook
+	}
+	if current, err := registries.GetDeploymentImage(m.clientset, change.Namespace, change.Deployment, change.Container); err == nil {
+		entry.Container, entry.OldImage = current.Container, current.Image
+	}
+	if recorded, err := m.history.Record(entry); err != nil {
+		fmt.Printf("Error recording history: %v\n", err)
+	} else {
+		entry = recorded
+	}
+	change.HistoryID = entry.ID
+
+	m.storeChange(&change)
+	m.notifier.Notify(entry)
+	fmt.Printf("Change %d for %s/%s: %s\n", change.ID, change.Namespace, change.Deployment, change.Reason)
+	return change
+}
+
+// revertCanary removes a temporary canary or puts a named one back on the
+// image it ran before.
+func (m *Manager) revertCanary(change Change) error {
+	canary := change.Canary
+	if canary.Temporary {
+		if canary.Deployment == "" {
+			return nil
+		}
+		return deployments.DeleteCanary(m.clientset, change.Namespace, canary.Deployment)
+	}
+
+	if canary.PreviousImage == "" {
+		return nil
+	}
+	_, err := registries.UpdateDeploymentImage(m.clientset, change.Namespace, canary.Deployment, registries.ImageUpdate{
+		Container: change.Container,
+		Image:     canary.PreviousImage,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to revert canary: %w", err)
+	}
+	return nil
+}
+
+func (m *Manager) storeChange(change *Change) {
+	if err := m.db.Update(func(tx *bolt.Tx) error { return putChange(tx, change) }); err != nil {
+		fmt.Printf("Error storing change %d: %v\n", change.ID, err)
+		return
+	}
+	m.updated(*change)
+}
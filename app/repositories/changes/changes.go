@@ -0,0 +1,542 @@
+package changes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chechetech/app/azure-go/config"
+	"github.com/chechetech/app/azure-go/repositories/deployments"
+	"github.com/chechetech/app/azure-go/repositories/history"
+	"github.com/chechetech/app/azure-go/repositories/notifications"
+	"github.com/chechetech/app/azure-go/repositories/registries"
+	bolt "go.etcd.io/bbolt"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	utilnet "k8s.io/apimachinery/pkg/util/net"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	StatusPending    = "pending"
+	StatusApproved   = "approved"
+	StatusCanary     = "canary"
+	StatusRejected   = "rejected"
+	StatusSuperseded = "superseded"
+	StatusApplied    = "applied"
+	StatusFailed     = "failed"
+)
+
+var (
+	ErrChangeNotFound = errors.New("change not found")
+	ErrChangeDecided  = errors.New("change is no longer pending")
+)
+
+// imageBackoff spaces out the attempts at patching an image, so an API
+// server that is away for a moment doesn't fail a change. Each change is
+// recorded and notified once, after the last attempt.
+var imageBackoff = wait.Backoff{Steps: 5, Duration: 2 * time.Second, Factor: 2, Jitter: 0.1}
+
+// Change is an image change for one container. Changes that can't be
+// applied right away are kept until they are approved and out of any
+// freeze window.
+type Change struct {
+	ID        uint64    `json:"id"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Action is the history action the change is recorded as;
+	// history.ActionWebhook when empty.
+	Action     string `json:"action,omitempty"`
+	WebhookID  string `json:"webhookId,omitempty"`
+	Actor      string `json:"actor,omitempty"`
+	Repository string `json:"repository,omitempty"`
+	// Source is the namespace/deployment a promoted image was taken from.
+	Source     string `json:"source,omitempty"`
+	Namespace  string `json:"namespace"`
+	Deployment string `json:"deployment"`
+	Container  string `json:"container,omitempty"`
+	Image      string `json:"image"`
+	Tag        string `json:"tag,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+
+	Status           string     `json:"status"`
+	Reason           string     `json:"reason,omitempty"`
+	RequiresApproval bool       `json:"requiresApproval"`
+	DecidedBy        string     `json:"decidedBy,omitempty"`
+	DecidedAt        *time.Time `json:"decidedAt,omitempty"`
+	HistoryID        uint64     `json:"historyId,omitempty"`
+	Canary           *Canary    `json:"canary,omitempty"`
+}
+
+// held reports whether the change is still waiting in the store.
+func (c Change) held() bool {
+	return c.ID != 0 && (c.Status == StatusPending || c.Status == StatusApproved)
+}
+
+// active reports whether the change is held or still on its canary.
+func (c Change) active() bool {
+	return c.held() || c.Status == StatusCanary
+}
+
+// Manager applies image changes, holding back the ones change control
+// doesn't allow yet and applying them once it does.
+//
+// Changes are read and moved between states in bolt transactions. The
+// cluster is changed under a lock per deployment, so changes to one
+// deployment land in order without those to others waiting on them; a
+// change read before taking the lock is read again, as a newer one may have
+// superseded it meanwhile. Changes made to a deployment outside the
+// manager take the same lock through Do and Override.
+type Manager struct {
+	// mu guards targets, the locks of the deployments.
+	mu        sync.Mutex
+	targets   map[string]*sync.Mutex
+	db        *bolt.DB
+	clientset *kubernetes.Clientset
+	cfg       *config.Config
+	history   *history.Store
+	rollouts  *deployments.RolloutTracker
+	notifier  *notifications.Notifier
+	onUpdate  func(Change)
+}
+
+func NewManager(db *bolt.DB, clientset *kubernetes.Clientset, cfg *config.Config, historyStore *history.Store, rollouts *deployments.RolloutTracker, notifier *notifications.Notifier) (*Manager, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(changesBucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create changes bucket: %w", err)
+	}
+
+	return &Manager{targets: map[string]*sync.Mutex{}, db: db, clientset: clientset, cfg: cfg, history: historyStore, rollouts: rollouts, notifier: notifier}, nil
+}
+
+// OnUpdate sets fn to be called after a stored change moves on: it is
+// decided, superseded, released, starts or leaves its canary, is applied or
+// fails. It must be set before Run.
+func (m *Manager) OnUpdate(fn func(Change)) {
+	m.onUpdate = fn
+}
+
+func (m *Manager) updated(change Change) {
+	if m.onUpdate != nil && change.ID != 0 {
+		m.onUpdate(change)
+	}
+}
+
+// lockTarget locks the deployment of change and returns the unlock.
+func (m *Manager) lockTarget(change Change) func() {
+	key := change.Namespace + "/" + change.Deployment
+	m.mu.Lock()
+	lock, ok := m.targets[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		m.targets[key] = lock
+	}
+	m.mu.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+// reread returns change as it is stored now.
+func (m *Manager) reread(change Change) (Change, error) {
+	var current Change
+	err := m.db.View(func(tx *bolt.Tx) error {
+		var found bool
+		var err error
+		current, found, err = getChange(tx, change.ID)
+		if err == nil && !found {
+			err = ErrChangeNotFound
+		}
+		return err
+	})
+	return current, err
+}
+
+// Submit applies change, or stores it as pending when a freeze window or an
+// approval requirement holds it back. Held changes and canaries for the same
+// container are superseded either way, so an older tag never lands after a
+// newer one.
+func (m *Manager) Submit(change Change) (Change, error) {
+	unlock := m.lockTarget(change)
+	defer unlock()
+
+	change.CreatedAt = time.Now()
+	change.Status = StatusPending
+
+	rule := m.cfg.ChangeControlFor(change.Namespace, change.Deployment)
+	change.RequiresApproval = rule != nil && rule.RequireApproval
+	change.Reason = m.holdReason(rule, change, change.CreatedAt)
+
+	var superseded, canaries []Change
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		superseded, canaries, err = supersede(tx, func(held Change) bool {
+			return held.Namespace == change.Namespace && held.Deployment == change.Deployment && held.Container == change.Container
+		}, "superseded by a newer change")
+		if err != nil {
+			return err
+		}
+
+		if change.Reason == "" {
+			return nil
+		}
+		return putChange(tx, &change)
+	})
+	if err != nil {
+		return change, fmt.Errorf("failed to store change: %w", err)
+	}
+	for _, held := range superseded {
+		m.updated(held)
+	}
+
+	// A canary the new change starts right away takes over the old one.
+	if change.Reason != "" || m.canaryPolicyFor(change) == nil {
+		for _, superseded := range canaries {
+			if err := m.revertCanary(superseded); err != nil {
+				fmt.Printf("Error reverting canary of change %d: %v\n", superseded.ID, err)
+			}
+		}
+	}
+
+	if change.Reason != "" {
+		fmt.Printf("Holding change %d for %s/%s: %s\n", change.ID, change.Namespace, change.Deployment, change.Reason)
+		return change, nil
+	}
+
+	return m.release(change)
+}
+
+// supersede marks the held changes and canaries match selects superseded
+// for reason. It returns them, and the canaries among them for the caller
+// to revert.
+func supersede(tx *bolt.Tx, match func(Change) bool, reason string) (superseded, canaries []Change, err error) {
+	err = eachChange(tx, func(held Change) error {
+		if !held.active() || !match(held) {
+			return nil
+		}
+		if held.Status == StatusCanary {
+			held.Canary.State = CanaryAborted
+			canaries = append(canaries, held)
+		}
+		held.Status, held.Reason = StatusSuperseded, reason
+		superseded = append(superseded, held)
+		return putChange(tx, &held)
+	})
+	return superseded, canaries, err
+}
+
+// Do runs fn, a change made to a deployment without the manager, under the
+// lock of the deployment, so it doesn't land in the middle of one of the
+// manager's own.
+func (m *Manager) Do(namespace, deployment string, fn func() error) error {
+	unlock := m.lockTarget(Change{Namespace: namespace, Deployment: deployment})
+	defer unlock()
+	return fn()
+}
+
+// Override is Do for changes that set the image of a deployment, like a
+// rollback. The held changes and canaries of the deployment are superseded
+// for reason first, so none of them lands later and undoes fn.
+func (m *Manager) Override(namespace, deployment, reason string, fn func() error) error {
+	unlock := m.lockTarget(Change{Namespace: namespace, Deployment: deployment})
+	defer unlock()
+
+	var superseded, canaries []Change
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		superseded, canaries, err = supersede(tx, func(held Change) bool {
+			return held.Namespace == namespace && held.Deployment == deployment
+		}, reason)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to supersede changes: %w", err)
+	}
+	for _, held := range superseded {
+		m.updated(held)
+	}
+	for _, canary := range canaries {
+		if err := m.revertCanary(canary); err != nil {
+			fmt.Printf("Error reverting canary of change %d: %v\n", canary.ID, err)
+		}
+	}
+
+	return fn()
+}
+
+// holdReason returns why change can't be applied at now, or "".
+func (m *Manager) holdReason(rule *config.ChangeControl, change Change, now time.Time) string {
+	if rule == nil {
+		return ""
+	}
+	if reason, ok := frozen(m.cfg, rule, now); ok {
+		return reason
+	}
+	if change.RequiresApproval && change.Status != StatusApproved {
+		return "awaiting approval"
+	}
+	return ""
+}
+
+// List returns the changes of a namespace, newest first. Without all only
+// the ones still held or on a canary are returned.
+func (m *Manager) List(namespace string, all bool) ([]Change, error) {
+	list := []Change{}
+	err := m.db.View(func(tx *bolt.Tx) error {
+		return eachChange(tx, func(change Change) error {
+			if change.Namespace == namespace && (all || change.active()) {
+				list = append([]Change{change}, list...)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read changes: %w", err)
+	}
+	return list, nil
+}
+
+// Approve marks a pending change approved and applies it unless a freeze
+// window still holds it, in which case Run applies it later.
+func (m *Manager) Approve(namespace string, id uint64, actor string) (Change, error) {
+	return m.decide(namespace, id, actor, StatusApproved)
+}
+
+func (m *Manager) Reject(namespace string, id uint64, actor string) (Change, error) {
+	return m.decide(namespace, id, actor, StatusRejected)
+}
+
+func (m *Manager) decide(namespace string, id uint64, actor, status string) (Change, error) {
+	var change Change
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		var found bool
+		var err error
+		change, found, err = getChange(tx, id)
+		if err != nil {
+			return err
+		}
+		if !found || change.Namespace != namespace {
+			return ErrChangeNotFound
+		}
+		if change.Status != StatusPending {
+			return ErrChangeDecided
+		}
+
+		now := time.Now()
+		change.Status, change.DecidedBy, change.DecidedAt = status, actor, &now
+		change.Reason = ""
+		if status == StatusApproved {
+			change.Reason = m.holdReason(m.cfg.ChangeControlFor(change.Namespace, change.Deployment), change, now)
+		}
+		return putChange(tx, &change)
+	})
+	if err != nil {
+		return change, err
+	}
+	m.updated(change)
+
+	if change.Status == StatusApproved && change.Reason == "" {
+		return m.releaseReady(change)
+	}
+	return change, nil
+}
+
+// Run applies held changes as soon as they are allowed, checking every
+// interval, and moves canaries along until ctx is done.
+func (m *Manager) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	canaryTicker := time.NewTicker(canaryCheckInterval)
+	defer canaryTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.releaseHeld()
+		case <-canaryTicker.C:
+			m.advanceCanaries()
+		}
+	}
+}
+
+func (m *Manager) releaseHeld() {
+	var ready, changed []Change
+	err := m.db.Update(func(tx *bolt.Tx) error {
+		ready, changed = nil, nil
+		now := time.Now()
+		return eachChange(tx, func(change Change) error {
+			if !change.held() {
+				return nil
+			}
+
+			reason := m.holdReason(m.cfg.ChangeControlFor(change.Namespace, change.Deployment), change, now)
+			if reason == "" {
+				ready = append(ready, change)
+			}
+			if reason != change.Reason {
+				change.Reason = reason
+				changed = append(changed, change)
+				return putChange(tx, &change)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		fmt.Printf("Error reading held changes: %v\n", err)
+		return
+	}
+	for _, change := range changed {
+		m.updated(change)
+	}
+
+	for _, change := range ready {
+		if _, err := m.releaseReady(change); err != nil {
+			fmt.Printf("Error applying change %d: %v\n", change.ID, err)
+		}
+	}
+}
+
+// releaseReady releases a held change change control allows, unless it
+// was superseded, held again or released by someone else since it was read.
+func (m *Manager) releaseReady(change Change) (Change, error) {
+	unlock := m.lockTarget(change)
+	defer unlock()
+
+	change, err := m.reread(change)
+	if err != nil || !change.held() || change.Reason != "" {
+		return change, err
+	}
+	return m.release(change)
+}
+
+// apply patches the image, records it in the history and notifies the
+// sinks, after watching the rollout in the background when the mapping asks
+// for it. The caller holds the lock of the deployment.
+func (m *Manager) apply(change Change) (Change, error) {
+	start := time.Now()
+	result, err := m.updateImage(change.Namespace, change.Deployment, registries.ImageUpdate{
+		Container: change.Container,
+		Image:     change.Image,
+		Tag:       change.Tag,
+		Digest:    change.Digest,
+	})
+
+	entry := history.Entry{
+		Time:       start,
+		Action:     change.Action,
+		WebhookID:  change.WebhookID,
+		Actor:      change.Actor,
+		Namespace:  change.Namespace,
+		Deployment: change.Deployment,
+		Container:  result.Container,
+		OldImage:   result.PreviousImage,
+		NewImage:   change.Image,
+		Tag:        change.Tag,
+		Digest:     change.Digest,
+		Result:     history.ResultApplied,
+	}
+	if entry.Action == "" {
+		entry.Action = history.ActionWebhook
+	}
+	var reasons []string
+	if change.Source != "" {
+		reasons = append(reasons, "promoted from "+change.Source)
+	}
+	if change.DecidedBy != "" {
+		reasons = append(reasons, fmt.Sprintf("change %d approved by %s", change.ID, change.DecidedBy))
+	}
+	entry.Reason = strings.Join(reasons, "; ")
+	if err != nil {
+		entry.Result, entry.Reason = history.ResultFailed, err.Error()
+	}
+	// Only deployments that exist get a history.
+	missing := apierrors.IsNotFound(err)
+	if (result.Changed || err != nil) && !missing {
+		entry.DurationMs = time.Since(start).Milliseconds()
+		if recorded, recordErr := m.history.Record(entry); recordErr != nil {
+			fmt.Printf("Error recording history: %v\n", recordErr)
+		} else {
+			entry = recorded
+		}
+	}
+
+	change.HistoryID = entry.ID
+	change.Status, change.Reason = StatusApplied, ""
+	if err != nil {
+		change.Status, change.Reason = StatusFailed, err.Error()
+	}
+	if change.ID != 0 {
+		m.storeChange(&change)
+	}
+	if err != nil {
+		if !missing {
+			m.notifier.Notify(entry)
+		}
+		return change, err
+	}
+
+	// Watching happens in the background so callers aren't kept waiting;
+	// the outcome is available from the rollouts endpoint, replaces the
+	// result in the history entry and is what gets notified.
+	rolloutPolicy := m.cfg.RolloutPolicyFor(m.cfg.MappingFor(change.Repository))
+	if result.Changed && !rolloutPolicy.Wait {
+		m.notifier.Notify(entry)
+	}
+	if result.Changed && rolloutPolicy.Wait {
+		rollout := deployments.Rollout{
+			ID:               change.WebhookID,
+			Namespace:        change.Namespace,
+			Deployment:       change.Deployment,
+			Image:            change.Image,
+			PreviousRevision: result.PreviousRevision,
+		}
+		go func() {
+			outcome := m.rollouts.Watch(m.clientset, rollout, result.Generation, rolloutPolicy.TimeoutDuration(), rolloutPolicy.Rollback)
+			entry.Result, entry.Reason = outcome.Status, outcome.Reason
+			entry.DurationMs = time.Since(start).Milliseconds()
+			if entry.ID != 0 {
+				if err := m.history.Update(entry); err != nil {
+					fmt.Printf("Error recording history: %v\n", err)
+				}
+			}
+			m.notifier.Notify(entry)
+		}()
+	}
+
+	return change, nil
+}
+
+// updateImage patches the image of a deployment, trying again while the
+// error is one another attempt could get past.
+func (m *Manager) updateImage(namespace, name string, update registries.ImageUpdate) (registries.UpdateResult, error) {
+	var result registries.UpdateResult
+	err := retry.OnError(imageBackoff, Retryable, func() error {
+		var err error
+		result, err = registries.UpdateDeploymentImage(m.clientset, namespace, name, update)
+		return err
+	})
+	return result, err
+}
+
+// Retryable reports whether another attempt could succeed: the error is a
+// conflict that outlasted RetryOnConflict, a timeout, a busy or unavailable
+// API server or a dropped connection. Anything else, like a missing
+// deployment or container or a rejected patch, won't fix itself.
+func Retryable(err error) bool {
+	if apierrors.IsConflict(err) || apierrors.IsTimeout(err) || apierrors.IsServerTimeout(err) ||
+		apierrors.IsTooManyRequests(err) || apierrors.IsServiceUnavailable(err) {
+		return true
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || utilnet.IsConnectionRefused(err) || utilnet.IsConnectionReset(err) || utilnet.IsProbableEOF(err)
+}
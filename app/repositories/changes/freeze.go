@@ -0,0 +1,41 @@
+package changes
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/chechetech/app/azure-go/config"
+)
+
+// frozen reports which freeze of rule covers now, if any.
+func frozen(cfg *config.Config, rule *config.ChangeControl, now time.Time) (string, bool) {
+	local := now.In(rule.Location())
+
+	today := local.Format(config.CalendarDateLayout)
+	for _, name := range rule.Calendars {
+		for _, date := range cfg.Calendars[name] {
+			if date == today {
+				return fmt.Sprintf("frozen by calendar %q on %s", name, date), true
+			}
+		}
+	}
+
+	midnight := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, local.Location())
+	offset := time.Duration(local.Weekday())*24*time.Hour + local.Sub(midnight)
+	for _, freeze := range rule.Freezes {
+		// Both were checked when the config was loaded.
+		start, _ := config.ParseWeekTime(freeze.Start)
+		end, _ := config.ParseWeekTime(freeze.End)
+
+		// A window like Fri 16:00 - Mon 08:00 wraps around Sunday.
+		inside := offset >= start && offset < end
+		if start > end {
+			inside = offset >= start || offset < end
+		}
+		if inside {
+			return fmt.Sprintf("frozen by window %q (%s - %s)", freeze.Name, freeze.Start, freeze.End), true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,51 @@
+package changes
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+
+	"github.com/chechetech/app/azure-go/config"
+)
+
+func TestFrozen(t *testing.T) {
+	cfg := &config.Config{Calendars: map[string][]string{"holidays": {"2026-12-25"}}}
+	rule := &config.ChangeControl{
+		Namespace: "prod",
+		TimeZone:  "Africa/Addis_Ababa",
+		Freezes: []config.FreezeWindow{
+			{Name: "weekend", Start: "Fri 16:00", End: "Mon 08:00"},
+			{Name: "release", Start: "Wed 09:00", End: "Wed 17:00"},
+		},
+		Calendars: []string{"holidays"},
+	}
+
+	// Addis Ababa is UTC+3.
+	tests := []struct {
+		now    string
+		frozen bool
+	}{
+		{"2026-10-16T12:59:00Z", false}, // Fri 15:59
+		{"2026-10-16T13:00:00Z", true},  // Fri 16:00
+		{"2026-10-17T12:00:00Z", true},  // Sat
+		{"2026-10-18T20:59:00Z", true},  // Sun 23:59
+		{"2026-10-18T21:30:00Z", true},  // Mon 00:30, past the wrap
+		{"2026-10-19T04:59:00Z", true},  // Mon 07:59
+		{"2026-10-19T05:00:00Z", false}, // Mon 08:00
+		{"2026-10-20T12:00:00Z", false}, // Tue
+		{"2026-10-21T05:59:00Z", false}, // Wed 08:59
+		{"2026-10-21T06:00:00Z", true},  // Wed 09:00
+		{"2026-10-21T14:00:00Z", false}, // Wed 17:00
+		{"2026-12-24T20:59:00Z", false}, // Thu 23:59
+		{"2026-12-24T21:00:00Z", true},  // Fri 25 00:00, a holiday
+	}
+	for _, test := range tests {
+		now, err := time.Parse(time.RFC3339, test.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reason, frozen := frozen(cfg, rule, now); frozen != test.frozen {
+			t.Errorf("frozen(%s) = %v (%s); want %v", test.now, frozen, reason, test.frozen)
+		}
+	}
+}
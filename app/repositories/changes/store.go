@@ -0,0 +1,58 @@
+package changes
+
+import (
+	"encoding/binary"
+	"encoding/json"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var changesBucket = []byte("changes")
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func putChange(tx *bolt.Tx, change *Change) error {
+	bucket := tx.Bucket(changesBucket)
+	if change.ID == 0 {
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		change.ID = id
+	}
+
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(itob(change.ID), data)
+}
+
+func getChange(tx *bolt.Tx, id uint64) (Change, bool, error) {
+	data := tx.Bucket(changesBucket).Get(itob(id))
+	if data == nil {
+		return Change{}, false, nil
+	}
+
+	var change Change
+	if err := json.Unmarshal(data, &change); err != nil {
+		return Change{}, false, err
+	}
+	return change, true, nil
+}
+
+// eachChange calls fn for every change, oldest first, until it returns an
+// error.
+func eachChange(tx *bolt.Tx, fn func(change Change) error) error {
+	return tx.Bucket(changesBucket).ForEach(func(k, v []byte) error {
+		var change Change
+		if err := json.Unmarshal(v, &change); err != nil {
+			return err
+		}
+		return fn(change)
+	})
+}
@@ -0,0 +1,77 @@
+package deployments
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/chechetech/app/azure-go/repositories/registries"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// RestartedAtAnnotation is the pod template annotation `kubectl rollout
+// restart` sets; changing it rolls every pod without changing the spec.
+const RestartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+
+// Scale sets the desired replicas through the scale subresource and returns
+// the previous count.
+func Scale(clientSet *kubernetes.Clientset, namespace, name string, replicas int32) (int32, error) {
+	var previous int32
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		scale, err := clientSet.AppsV1().Deployments(namespace).GetScale(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get scale: %w", err)
+		}
+
+		previous = scale.Spec.Replicas
+		scale.Spec.Replicas = replicas
+
+		_, err = clientSet.AppsV1().Deployments(namespace).UpdateScale(context.TODO(), name, scale, metav1.UpdateOptions{FieldManager: registries.FieldManager})
+		if err != nil {
+			return fmt.Errorf("failed to update scale: %w", err)
+		}
+		return nil
+	})
+
+	return previous, err
+}
+
+// Restart rolls every pod of the deployment, like `kubectl rollout restart`.
+func Restart(clientSet *kubernetes.Clientset, namespace, name string) error {
+	return patchDeployment(clientSet, namespace, name, map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{RestartedAtAnnotation: time.Now().Format(time.RFC3339)},
+				},
+			},
+		},
+	})
+}
+
+// SetPaused pauses or resumes the rollout of the deployment.
+func SetPaused(clientSet *kubernetes.Clientset, namespace, name string, paused bool) error {
+	return patchDeployment(clientSet, namespace, name, map[string]interface{}{
+		"spec": map[string]interface{}{
+			"paused": paused,
+		},
+	})
+}
+
+func patchDeployment(clientSet *kubernetes.Clientset, namespace, name string, patch map[string]interface{}) error {
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+
+	_, err = clientSet.AppsV1().Deployments(namespace).Patch(context.TODO(), name, types.StrategicMergePatchType, data, metav1.PatchOptions{FieldManager: registries.FieldManager})
+	if err != nil {
+		return fmt.Errorf("failed to patch deployment: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,164 @@
+package deployments
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/chechetech/app/azure-go/repositories/registries"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// CanaryLabel is added to the selector and pods of temporary canaries so
+// they don't overlap the ReplicaSets of the deployment they copy. Services
+// selecting the deployment's pods still send the canary a share of the
+// traffic.
+const CanaryLabel = "dashboard-api/canary"
+
+// CanaryName is the name of the temporary canary of a deployment.
+func CanaryName(name string) string {
+	return name + "-canary"
+}
+
+// CreateCanary creates the temporary canary of a deployment as a copy of it
+// running update with the replicas returned by replicasFor, or updates the
+// one left by an earlier change. It returns the canary's name and the
+// generation to wait for.
+func CreateCanary(clientSet *kubernetes.Clientset, namespace, name string, replicasFor func(replicas int32) int32, update registries.ImageUpdate) (string, int64, error) {
+	deployment, err := clientSet.AppsV1().Deployments(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to get deployment: %w", err)
+	}
+
+	canaryName := CanaryName(name)
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	replicas = replicasFor(replicas)
+
+	if _, err := clientSet.AppsV1().Deployments(namespace).Get(context.TODO(), canaryName, metav1.GetOptions{}); err == nil {
+		if _, err := Scale(clientSet, namespace, canaryName, replicas); err != nil {
+			return "", 0, err
+		}
+		result, err := registries.UpdateDeploymentImage(clientSet, namespace, canaryName, update)
+		return canaryName, result.Generation, err
+	} else if !apierrors.IsNotFound(err) {
+		return "", 0, fmt.Errorf("failed to get canary: %w", err)
+	}
+
+	canary := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        canaryName,
+			Namespace:   namespace,
+			Labels:      copyLabels(deployment.Labels),
+			Annotations: map[string]string{},
+		},
+		Spec: *deployment.Spec.DeepCopy(),
+	}
+	canary.Labels[CanaryLabel] = name
+	canary.Spec.Replicas = &replicas
+	canary.Spec.Paused = false
+
+	// copyLabels also covers a template without labels.
+	canary.Spec.Selector.MatchLabels = copyLabels(canary.Spec.Selector.MatchLabels)
+	canary.Spec.Selector.MatchLabels[CanaryLabel] = name
+	canary.Spec.Template.Labels = copyLabels(canary.Spec.Template.Labels)
+	canary.Spec.Template.Labels[CanaryLabel] = name
+	// The recorded tags describe the deployment's images, not the canary's.
+	delete(canary.Spec.Template.Annotations, registries.ImageTagsAnnotation)
+
+	container := -1
+	for i, c := range canary.Spec.Template.Spec.Containers {
+		if c.Name == update.Container || (update.Container == "" && i == 0) {
+			container = i
+			break
+		}
+	}
+	if container < 0 {
+		return "", 0, fmt.Errorf("deployment %s has no container %q", name, update.Container)
+	}
+	canary.Spec.Template.Spec.Containers[container].Image = update.Image
+
+	created, err := clientSet.AppsV1().Deployments(namespace).Create(context.TODO(), canary, metav1.CreateOptions{FieldManager: registries.FieldManager})
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create canary: %w", err)
+	}
+
+	return canaryName, created.Generation, nil
+}
+
+// DeleteCanary removes a temporary canary; one that is already gone is not
+// an error.
+func DeleteCanary(clientSet *kubernetes.Clientset, namespace, canaryName string) error {
+	policy := metav1.DeletePropagationForeground
+	err := clientSet.AppsV1().Deployments(namespace).Delete(context.TODO(), canaryName, metav1.DeleteOptions{PropagationPolicy: &policy})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("failed to delete canary: %w", err)
+	}
+	return nil
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	copied := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		copied[k] = v
+	}
+	return copied
+}
+
+// RolloutStatus reports, without waiting, whether generation of the
+// deployment has rolled out. See WaitForRollout.
+func RolloutStatus(clientSet *kubernetes.Clientset, namespace, name string, generation int64) (bool, error) {
+	deployment, err := clientSet.AppsV1().Deployments(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return false, fmt.Errorf("failed to get deployment: %w", err)
+	}
+	return rolloutComplete(deployment, generation)
+}
+
+// Health sums up the pods of a deployment's current ReplicaSet.
+type Health struct {
+	Pods     []corev1.Pod
+	Ready    int
+	Restarts int32
+}
+
+// GetHealth counts the ready pods and container restarts of the newest
+// ReplicaSet of a deployment.
+func GetHealth(clientSet *kubernetes.Clientset, namespace, name string) (Health, error) {
+	deployment, err := GetDeployment(clientSet, nil, namespace, name)
+	if err != nil {
+		return Health{}, fmt.Errorf("failed to get deployment: %w", err)
+	}
+
+	replicaSets, err := GetReplicaSets(clientSet, nil, deployment)
+	if err != nil {
+		return Health{}, err
+	}
+	if len(replicaSets) == 0 {
+		return Health{}, nil
+	}
+
+	pods, err := GetDeploymentPods(clientSet, nil, deployment, replicaSets[:1])
+	if err != nil {
+		return Health{}, err
+	}
+
+	health := Health{Pods: pods}
+	for _, pod := range pods {
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == corev1.PodReady && condition.Status == corev1.ConditionTrue {
+				health.Ready++
+			}
+		}
+		for _, status := range pod.Status.ContainerStatuses {
+			health.Restarts += status.RestartCount
+		}
+	}
+
+	return health, nil
+}
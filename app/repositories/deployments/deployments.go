@@ -0,0 +1,113 @@
+package deployments
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/chechetech/app/azure-go/repositories/cache"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// GetDeployments lists the deployments of namespace, from store when it has
+// synced them.
+func GetDeployments(clientSet *kubernetes.Clientset, store *cache.Cache, namespace string) (*appsv1.DeploymentList, error) {
+	if lister, ok := store.Deployments(namespace); ok {
+		cached, err := lister.List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		deployments := &appsv1.DeploymentList{}
+		for _, deployment := range cached {
+			deployments.Items = append(deployments.Items, *deployment)
+		}
+		// The API server lists by name too.
+		sort.Slice(deployments.Items, func(i, j int) bool { return deployments.Items[i].Name < deployments.Items[j].Name })
+		return deployments, nil
+	}
+
+	deployments, err := clientSet.AppsV1().Deployments(namespace).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return deployments, nil
+
+}
+
+// GetDeployment gets a deployment, from store when it has synced them.
+// Changes must start from the API server's copy, so they pass a nil store.
+func GetDeployment(clientSet *kubernetes.Clientset, store *cache.Cache, namespace, name string) (*appsv1.Deployment, error) {
+	if lister, ok := store.Deployments(namespace); ok {
+		deployment, err := lister.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		return deployment.DeepCopy(), nil
+	}
+
+	deployment, err := clientSet.AppsV1().Deployments(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return deployment, nil
+
+}
+
+// GetDeploymentPods returns the pods controlled by one of replicaSets, which
+// should be the ReplicaSets of deployment.
+func GetDeploymentPods(clientSet *kubernetes.Clientset, store *cache.Cache, deployment *appsv1.Deployment, replicaSets []appsv1.ReplicaSet) ([]corev1.Pod, error) {
+	selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector: %w", err)
+	}
+
+	var pods []corev1.Pod
+	if lister, ok := store.Pods(deployment.Namespace); ok {
+		cached, err := lister.List(selector)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list pods: %w", err)
+		}
+		for _, pod := range cached {
+			pods = append(pods, *pod)
+		}
+		sort.Slice(pods, func(i, j int) bool { return pods[i].Name < pods[j].Name })
+	} else {
+		list, err := clientSet.CoreV1().Pods(deployment.Namespace).List(context.Background(), metav1.ListOptions{LabelSelector: selector.String()})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list pods: %w", err)
+		}
+		pods = list.Items
+	}
+
+	owners := map[string]bool{}
+	for _, replicaSet := range replicaSets {
+		owners[string(replicaSet.UID)] = true
+	}
+
+	var owned []corev1.Pod
+	for _, pod := range pods {
+		if owner := metav1.GetControllerOf(&pod); owner != nil && owners[string(owner.UID)] {
+			owned = append(owned, pod)
+		}
+	}
+
+	return owned, nil
+}
+
+// OwnsPod reports whether pod belongs to one of the ReplicaSets of
+// deployment, by the name the deployment controller gives them. Unlike
+// GetDeploymentPods it needs no ReplicaSets, so it also holds for those
+// created after the check started.
+func OwnsPod(deployment *appsv1.Deployment, pod *corev1.Pod) bool {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil || owner.Kind != "ReplicaSet" {
+		return false
+	}
+	return owner.Name == deployment.Name+"-"+pod.Labels[appsv1.DefaultDeploymentUniqueLabelKey]
+}
@@ -0,0 +1,69 @@
+package deployments
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/chechetech/app/azure-go/repositories/cache"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+)
+
+// GetDeploymentEvents returns the events about deployment, its ReplicaSets
+// and its pods, most recent first, from store when it has synced them.
+func GetDeploymentEvents(clientSet *kubernetes.Clientset, store *cache.Cache, deployment *appsv1.Deployment, replicaSets []appsv1.ReplicaSet, pods []corev1.Pod) ([]corev1.Event, error) {
+	objects := map[types.UID]bool{deployment.UID: true}
+	for _, replicaSet := range replicaSets {
+		objects[replicaSet.UID] = true
+	}
+	for _, pod := range pods {
+		objects[pod.UID] = true
+	}
+
+	var events []corev1.Event
+	if lister, ok := store.Events(deployment.Namespace); ok {
+		cached, err := lister.List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range cached {
+			events = append(events, *event)
+		}
+	} else {
+		list, err := clientSet.CoreV1().Events(deployment.Namespace).List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		events = list.Items
+	}
+
+	var matching []corev1.Event
+	for _, event := range events {
+		if objects[event.InvolvedObject.UID] {
+			matching = append(matching, event)
+		}
+	}
+
+	sort.SliceStable(matching, func(i, j int) bool {
+		return LastSeen(matching[i]).After(LastSeen(matching[j]))
+	})
+
+	return matching, nil
+}
+
+// LastSeen is when an event last happened. Events from the events.k8s.io
+// API only set EventTime and their series.
+func LastSeen(event corev1.Event) time.Time {
+	switch {
+	case event.Series != nil:
+		return event.Series.LastObservedTime.Time
+	case !event.LastTimestamp.IsZero():
+		return event.LastTimestamp.Time
+	}
+	return event.EventTime.Time
+}
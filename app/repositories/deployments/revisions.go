@@ -0,0 +1,169 @@
+package deployments
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/chechetech/app/azure-go/repositories/cache"
+	"github.com/chechetech/app/azure-go/repositories/registries"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// ErrRevisionNotFound is returned when a rollback names a revision the
+// deployment no longer has a ReplicaSet for.
+var ErrRevisionNotFound = errors.New("revision not found")
+
+// GetReplicaSets returns the ReplicaSets owned by deployment, newest
+// first, from store when it has synced them.
+func GetReplicaSets(clientSet *kubernetes.Clientset, store *cache.Cache, deployment *appsv1.Deployment) ([]appsv1.ReplicaSet, error) {
+	selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid selector: %w", err)
+	}
+
+	var replicaSets []appsv1.ReplicaSet
+	if lister, ok := store.ReplicaSets(deployment.Namespace); ok {
+		cached, err := lister.List(selector)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list replica sets: %w", err)
+		}
+		for _, replicaSet := range cached {
+			replicaSets = append(replicaSets, *replicaSet)
+		}
+	} else {
+		list, err := clientSet.AppsV1().ReplicaSets(deployment.Namespace).List(context.TODO(), metav1.ListOptions{LabelSelector: selector.String()})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list replica sets: %w", err)
+		}
+		replicaSets = list.Items
+	}
+
+	var owned []appsv1.ReplicaSet
+	for _, replicaSet := range replicaSets {
+		if metav1.IsControlledBy(&replicaSet, deployment) {
+			owned = append(owned, replicaSet)
+		}
+	}
+
+	sort.Slice(owned, func(i, j int) bool {
+		return Revision(&owned[i].ObjectMeta) > Revision(&owned[j].ObjectMeta)
+	})
+
+	return owned, nil
+}
+
+// Revision reads the revision annotation of a Deployment or ReplicaSet,
+// returning 0 when it is missing.
+func Revision(meta *metav1.ObjectMeta) int64 {
+	revision, _ := strconv.ParseInt(meta.Annotations[registries.RevisionAnnotation], 10, 64)
+	return revision
+}
+
+// RollbackResult tells which revision a rollback left and which it
+// restored, with the image change of the first container for the history.
+type RollbackResult struct {
+	FromRevision int64  `json:"fromRevision"`
+	ToRevision   int64  `json:"toRevision"`
+	Container    string `json:"container"`
+	OldImage     string `json:"oldImage"`
+	NewImage     string `json:"newImage"`
+}
+
+// Rollback restores revision, or the revision before the current one when
+// revision is 0.
+func Rollback(clientSet *kubernetes.Clientset, namespace, name string, revision int64) (RollbackResult, error) {
+	deployment, err := clientSet.AppsV1().Deployments(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		return RollbackResult{}, fmt.Errorf("failed to get deployment: %w", err)
+	}
+
+	result := RollbackResult{FromRevision: Revision(&deployment.ObjectMeta), ToRevision: revision}
+	if revision == 0 {
+		replicaSets, err := GetReplicaSets(clientSet, nil, deployment)
+		if err != nil {
+			return RollbackResult{}, err
+		}
+		for _, replicaSet := range replicaSets {
+			if r := Revision(&replicaSet.ObjectMeta); r < result.FromRevision {
+				result.ToRevision = r
+				break
+			}
+		}
+		if result.ToRevision == 0 {
+			return RollbackResult{}, fmt.Errorf("deployment %s has no revision before %d: %w", name, result.FromRevision, ErrRevisionNotFound)
+		}
+	}
+
+	rolledBack, err := RollbackToRevision(clientSet, namespace, name, result.ToRevision)
+	if err != nil {
+		return RollbackResult{}, err
+	}
+
+	if containers := deployment.Spec.Template.Spec.Containers; len(containers) > 0 {
+		result.Container, result.OldImage = containers[0].Name, containers[0].Image
+	}
+	if containers := rolledBack.Spec.Template.Spec.Containers; len(containers) > 0 {
+		result.NewImage = containers[0].Image
+	}
+
+	return result, nil
+}
+
+// RollbackToRevision restores the pod template of the ReplicaSet with the
+// given revision, like `kubectl rollout undo --to-revision`. The deployment
+// controller then records it as a new revision.
+func RollbackToRevision(clientSet *kubernetes.Clientset, namespace, name string, revision int64) (*appsv1.Deployment, error) {
+	var rolledBack *appsv1.Deployment
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		deployment, err := clientSet.AppsV1().Deployments(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get deployment: %w", err)
+		}
+
+		replicaSets, err := GetReplicaSets(clientSet, nil, deployment)
+		if err != nil {
+			return err
+		}
+
+		var target *appsv1.ReplicaSet
+		for i := range replicaSets {
+			if Revision(&replicaSets[i].ObjectMeta) == revision {
+				target = &replicaSets[i]
+				break
+			}
+		}
+		if target == nil {
+			return fmt.Errorf("deployment %s has no revision %d: %w", name, revision, ErrRevisionNotFound)
+		}
+
+		template := target.Spec.Template.DeepCopy()
+		delete(template.Labels, appsv1.DefaultDeploymentUniqueLabelKey)
+
+		// Replacing the whole template drops containers and env vars the
+		// bad revision added, which a merge patch would keep. Setting the
+		// resourceVersion makes a concurrent change surface as a conflict.
+		patch, err := json.Marshal([]map[string]interface{}{
+			{"op": "replace", "path": "/metadata/resourceVersion", "value": deployment.ResourceVersion},
+			{"op": "replace", "path": "/spec/template", "value": template},
+		})
+		if err != nil {
+			return err
+		}
+
+		rolledBack, err = clientSet.AppsV1().Deployments(namespace).Patch(context.TODO(), name, types.JSONPatchType, patch, metav1.PatchOptions{FieldManager: registries.FieldManager})
+		if err != nil {
+			return fmt.Errorf("failed to patch deployment: %w", err)
+		}
+		return nil
+	})
+
+	return rolledBack, err
+}
@@ -0,0 +1,73 @@
+package deployments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+const rolloutPollInterval = 2 * time.Second
+
+// ErrProgressDeadlineExceeded is returned for a rollout the controller gave
+// up on.
+var ErrProgressDeadlineExceeded = errors.New("exceeded its progress deadline")
+
+// WaitForRollout blocks until every replica of the deployment runs the
+// template of generation, the same way `kubectl rollout status` does. It
+// fails early when the controller reports ProgressDeadlineExceeded.
+func WaitForRollout(ctx context.Context, clientSet *kubernetes.Clientset, namespace, name string, generation int64) error {
+	var lastErr error
+	err := wait.PollUntilContextCancel(ctx, rolloutPollInterval, true, func(ctx context.Context) (bool, error) {
+		deployment, err := clientSet.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			// Keep polling through API hiccups; the timeout bounds us.
+			lastErr = err
+			return false, nil
+		}
+		return rolloutComplete(deployment, generation)
+	})
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		if lastErr != nil {
+			return fmt.Errorf("rollout did not complete in time: %w", lastErr)
+		}
+		return errors.New("rollout did not complete in time")
+	}
+	return err
+}
+
+func rolloutComplete(deployment *appsv1.Deployment, generation int64) (bool, error) {
+	if deployment.Status.ObservedGeneration < generation {
+		return false, nil
+	}
+
+	for _, condition := range deployment.Status.Conditions {
+		if condition.Type == appsv1.DeploymentProgressing && condition.Reason == "ProgressDeadlineExceeded" {
+			return false, fmt.Errorf("deployment %s %w: %s", deployment.Name, ErrProgressDeadlineExceeded, condition.Message)
+		}
+	}
+
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+
+	status := deployment.Status
+	if status.UpdatedReplicas < replicas {
+		return false, nil
+	}
+	if status.Replicas > status.UpdatedReplicas {
+		return false, nil
+	}
+	if status.AvailableReplicas < status.UpdatedReplicas {
+		return false, nil
+	}
+
+	return true, nil
+}
@@ -0,0 +1,126 @@
+package deployments
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	RolloutProgressing    = "progressing"
+	RolloutComplete       = "complete"
+	RolloutFailed         = "failed"
+	RolloutRolledBack     = "rolledBack"
+	RolloutRollbackFailed = "rollbackFailed"
+)
+
+// Rollout is the outcome of one image change that is being watched.
+type Rollout struct {
+	ID               string     `json:"id"`
+	Namespace        string     `json:"namespace"`
+	Deployment       string     `json:"deployment"`
+	Image            string     `json:"image"`
+	PreviousRevision string     `json:"previousRevision,omitempty"`
+	Status           string     `json:"status"`
+	Reason           string     `json:"reason,omitempty"`
+	StartedAt        time.Time  `json:"startedAt"`
+	FinishedAt       *time.Time `json:"finishedAt,omitempty"`
+}
+
+// RolloutTracker keeps the most recent rollouts of each deployment.
+type RolloutTracker struct {
+	mu       sync.Mutex
+	rollouts map[string][]Rollout
+	size     int
+}
+
+func NewRolloutTracker(size int) *RolloutTracker {
+	return &RolloutTracker{rollouts: map[string][]Rollout{}, size: size}
+}
+
+func rolloutKey(namespace, deployment string) string {
+	return namespace + "/" + deployment
+}
+
+func (t *RolloutTracker) set(rollout Rollout) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := rolloutKey(rollout.Namespace, rollout.Deployment)
+	rollouts := t.rollouts[key]
+	for i := range rollouts {
+		if rollouts[i].ID == rollout.ID {
+			rollouts[i] = rollout
+			return
+		}
+	}
+
+	rollouts = append(rollouts, rollout)
+	if len(rollouts) > t.size {
+		rollouts = rollouts[len(rollouts)-t.size:]
+	}
+	t.rollouts[key] = rollouts
+}
+
+// List returns the rollouts of a deployment, newest first.
+func (t *RolloutTracker) List(namespace, deployment string) []Rollout {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rollouts := t.rollouts[rolloutKey(namespace, deployment)]
+	list := make([]Rollout, 0, len(rollouts))
+	for i := len(rollouts) - 1; i >= 0; i-- {
+		list = append(list, rollouts[i])
+	}
+	return list
+}
+
+// Watch records rollout as progressing, waits for generation to roll out
+// and records the outcome. When rollback is set a failed rollout is undone
+// by restoring rollout.PreviousRevision. It blocks, so run it in a
+// goroutine.
+func (t *RolloutTracker) Watch(clientSet *kubernetes.Clientset, rollout Rollout, generation int64, timeout time.Duration, rollback bool) Rollout {
+	rollout.Status = RolloutProgressing
+	rollout.StartedAt = time.Now()
+	if rollout.ID == "" {
+		rollout.ID = strconv.FormatInt(rollout.StartedAt.UnixNano(), 10)
+	}
+	t.set(rollout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := WaitForRollout(ctx, clientSet, rollout.Namespace, rollout.Deployment, generation)
+	switch {
+	case err == nil:
+		rollout.Status = RolloutComplete
+	case !rollback:
+		rollout.Status, rollout.Reason = RolloutFailed, err.Error()
+	default:
+		rollout.Status, rollout.Reason = t.rollback(clientSet, rollout, err)
+	}
+
+	finishedAt := time.Now()
+	rollout.FinishedAt = &finishedAt
+	t.set(rollout)
+
+	fmt.Printf("Rollout %s of %s/%s: %s %s\n", rollout.ID, rollout.Namespace, rollout.Deployment, rollout.Status, rollout.Reason)
+	return rollout
+}
+
+func (t *RolloutTracker) rollback(clientSet *kubernetes.Clientset, rollout Rollout, cause error) (string, string) {
+	revision, err := strconv.ParseInt(rollout.PreviousRevision, 10, 64)
+	if err != nil || revision == 0 {
+		return RolloutRollbackFailed, fmt.Sprintf("%v; no previous revision to roll back to", cause)
+	}
+
+	if _, err := RollbackToRevision(clientSet, rollout.Namespace, rollout.Deployment, revision); err != nil {
+		return RolloutRollbackFailed, fmt.Sprintf("%v; rollback failed: %v", cause, err)
+	}
+
+	return RolloutRolledBack, fmt.Sprintf("%v; rolled back to revision %d", cause, revision)
+}
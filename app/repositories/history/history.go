@@ -0,0 +1,172 @@
+package history
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	ActionWebhook   = "webhook"
+	ActionPromotion = "promotion"
+	ActionDeploy    = "deploy"
+	ActionRollback  = "rollback"
+	ActionScale     = "scale"
+	ActionRestart   = "restart"
+	ActionPause     = "pause"
+	ActionResume    = "resume"
+
+	ResultApplied = "applied"
+	ResultFailed  = "failed"
+)
+
+// Entry is one change made to a deployment. Result is ResultApplied or
+// ResultFailed when the change is made, and is replaced by the rollout
+// outcome when the rollout is watched.
+type Entry struct {
+	ID         uint64    `json:"id"`
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	WebhookID  string    `json:"webhookId,omitempty"`
+	Actor      string    `json:"actor,omitempty"`
+	Namespace  string    `json:"namespace"`
+	Deployment string    `json:"deployment"`
+	Container  string    `json:"container,omitempty"`
+	OldImage   string    `json:"oldImage,omitempty"`
+	NewImage   string    `json:"newImage,omitempty"`
+	Tag        string    `json:"tag,omitempty"`
+	Digest     string    `json:"digest,omitempty"`
+	Result     string    `json:"result"`
+	Reason     string    `json:"reason,omitempty"`
+	DurationMs int64     `json:"durationMs"`
+}
+
+var historyBucket = []byte("history")
+
+// Store keeps entries in a bolt database, one nested bucket per deployment
+// keyed by a big-endian sequence so a cursor walks them in order.
+type Store struct {
+	db *bolt.DB
+}
+
+func New(db *bolt.DB) (*Store, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(historyBucket)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create history bucket: %w", err)
+	}
+
+	return &Store{db: db}, nil
+}
+
+func deploymentKey(namespace, deployment string) []byte {
+	return []byte(namespace + "/" + deployment)
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// Record stores entry and returns it with its ID set.
+func (s *Store) Record(entry Entry) (Entry, error) {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(historyBucket).CreateBucketIfNotExists(deploymentKey(entry.Namespace, entry.Deployment))
+		if err != nil {
+			return err
+		}
+
+		entry.ID, err = bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(itob(entry.ID), data)
+	})
+	if err != nil {
+		return Entry{}, fmt.Errorf("failed to record history: %w", err)
+	}
+
+	return entry, nil
+}
+
+// Update overwrites an entry returned by Record.
+func (s *Store) Update(entry Entry) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(historyBucket).Bucket(deploymentKey(entry.Namespace, entry.Deployment))
+		if bucket == nil || bucket.Get(itob(entry.ID)) == nil {
+			return fmt.Errorf("entry %d not found", entry.ID)
+		}
+
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(itob(entry.ID), data)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update history: %w", err)
+	}
+
+	return nil
+}
+
+// Get returns the entry of a deployment with the given ID.
+func (s *Store) Get(namespace, deployment string, id uint64) (Entry, bool, error) {
+	var entry Entry
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(historyBucket).Bucket(deploymentKey(namespace, deployment))
+		if bucket == nil {
+			return nil
+		}
+
+		data := bucket.Get(itob(id))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, &entry)
+	})
+	if err != nil {
+		return Entry{}, false, fmt.Errorf("failed to read history: %w", err)
+	}
+
+	return entry, found, nil
+}
+
+// List returns up to limit entries of a deployment, newest first.
+func (s *Store) List(namespace, deployment string, limit int) ([]Entry, error) {
+	entries := []Entry{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(historyBucket).Bucket(deploymentKey(namespace, deployment))
+		if bucket == nil {
+			return nil
+		}
+
+		cursor := bucket.Cursor()
+		for k, v := cursor.Last(); k != nil && len(entries) < limit; k, v = cursor.Prev() {
+			var entry Entry
+			if err := json.Unmarshal(v, &entry); err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history: %w", err)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,183 @@
+package notifications
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/chechetech/app/azure-go/config"
+	"github.com/chechetech/app/azure-go/repositories/deployments"
+	"github.com/chechetech/app/azure-go/repositories/history"
+)
+
+// Event is what the sinks are told about an image change. OldImage is what
+// ran before and NewImage what runs now, also after a rollback.
+type Event struct {
+	Event      string    `json:"event"`
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	Actor      string    `json:"actor,omitempty"`
+	WebhookID  string    `json:"webhookId,omitempty"`
+	HistoryID  uint64    `json:"historyId,omitempty"`
+	Namespace  string    `json:"namespace"`
+	Deployment string    `json:"deployment"`
+	Container  string    `json:"container,omitempty"`
+	OldImage   string    `json:"oldImage,omitempty"`
+	NewImage   string    `json:"newImage,omitempty"`
+	Tag        string    `json:"tag,omitempty"`
+	Digest     string    `json:"digest,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Message    string    `json:"message"`
+}
+
+var defaultTemplates = map[string]*template.Template{
+	config.EventDeployed: template.Must(template.New(config.EventDeployed).Parse(
+		"{{.Namespace}}/{{.Deployment}}: deployed {{.NewImage}}{{if .OldImage}} (was {{.OldImage}}){{end}}{{if .Actor}} by {{.Actor}}{{end}}")),
+	config.EventFailed: template.Must(template.New(config.EventFailed).Parse(
+		"{{.Namespace}}/{{.Deployment}}: failed to deploy {{.NewImage}}: {{.Reason}}")),
+	config.EventRolledBack: template.Must(template.New(config.EventRolledBack).Parse(
+		"{{.Namespace}}/{{.Deployment}}: rolled back from {{.OldImage}} to {{.NewImage}}{{if .Reason}}: {{.Reason}}{{end}}")),
+}
+
+// Notifier sends image change events to the sinks configured for their
+// namespace.
+type Notifier struct {
+	cfg    *config.Config
+	client *http.Client
+}
+
+func New(cfg *config.Config) *Notifier {
+	return &Notifier{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Notify tells the sinks about a history entry of an image change. Entries
+// of other actions and rollouts still in progress are ignored. Sending
+// happens in the background and failures are only logged, since the change
+// has already been made.
+func (n *Notifier) Notify(entry history.Entry) {
+	event, ok := eventFor(entry)
+	if !ok {
+		return
+	}
+
+	for _, sink := range n.cfg.NotificationsFor(event.Namespace, event.Event) {
+		go func(sink config.Notification) {
+			if err := n.send(sink, event); err != nil {
+				fmt.Printf("Error sending %s notification %s: %v\n", event.Event, sink.Name, err)
+			}
+		}(sink)
+	}
+}
+
+func eventFor(entry history.Entry) (Event, bool) {
+	switch entry.Action {
+	case history.ActionWebhook, history.ActionPromotion, history.ActionDeploy, history.ActionRollback:
+	default:
+		return Event{}, false
+	}
+
+	event := Event{
+		Time:       entry.Time,
+		Action:     entry.Action,
+		Actor:      entry.Actor,
+		WebhookID:  entry.WebhookID,
+		HistoryID:  entry.ID,
+		Namespace:  entry.Namespace,
+		Deployment: entry.Deployment,
+		Container:  entry.Container,
+		OldImage:   entry.OldImage,
+		NewImage:   entry.NewImage,
+		Tag:        entry.Tag,
+		Digest:     entry.Digest,
+		Reason:     entry.Reason,
+	}
+
+	switch {
+	case entry.Result == deployments.RolloutProgressing:
+		return Event{}, false
+	case entry.Result == history.ResultFailed || entry.Result == deployments.RolloutFailed || entry.Result == deployments.RolloutRollbackFailed:
+		event.Event = config.EventFailed
+	case entry.Result == deployments.RolloutRolledBack:
+		// The entry describes the change that was undone.
+		event.Event = config.EventRolledBack
+		event.OldImage, event.NewImage = entry.NewImage, entry.OldImage
+	case entry.Action == history.ActionRollback:
+		event.Event = config.EventRolledBack
+	default:
+		event.Event = config.EventDeployed
+	}
+
+	return event, true
+}
+
+func (n *Notifier) send(sink config.Notification, event Event) error {
+	tmpl := defaultTemplates[event.Event]
+	if sink.Template != "" {
+		var err error
+		if tmpl, err = template.New(sink.Name).Parse(sink.Template); err != nil {
+			return err
+		}
+	}
+
+	var message bytes.Buffer
+	if err := tmpl.Execute(&message, event); err != nil {
+		return fmt.Errorf("failed to render template: %w", err)
+	}
+	event.Message = message.String()
+
+	switch sink.Type {
+	case config.NotifySlack, config.NotifyTeams:
+		return n.post(sink.URL, map[string]string{"text": event.Message})
+	case config.NotifyWebhook:
+		return n.post(sink.URL, event)
+	case config.NotifyEmail:
+		return sendEmail(sink.Email, event)
+	}
+	return fmt.Errorf("unknown notification type %q", sink.Type)
+}
+
+func (n *Notifier) post(url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	response, err := n.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", response.Status)
+	}
+	return nil
+}
+
+func sendEmail(email *config.Email, event Event) error {
+	port := email.Port
+	if port == 0 {
+		port = 587
+	}
+
+	var auth smtp.Auth
+	if email.Username != "" {
+		auth = smtp.PlainAuth("", email.Username, os.Getenv(email.PasswordEnv), email.Host)
+	}
+
+	subject := fmt.Sprintf("[%s/%s] %s", event.Namespace, event.Deployment, event.Event)
+	message := "From: " + email.From + "\r\n" +
+		"To: " + strings.Join(email.To, ", ") + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n\r\n" +
+		event.Message + "\r\n"
+
+	return smtp.SendMail(email.Host+":"+strconv.Itoa(port), auth, email.From, email.To, []byte(message))
+}
@@ -0,0 +1,181 @@
+package pods
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ErrUnknownLevel is returned for a level LogFilter doesn't know.
+var ErrUnknownLevel = errors.New("unknown level, use one of trace, debug, info, warn, error or fatal")
+
+// levels ranks the level names loggers commonly use.
+var levels = map[string]int{
+	"trace":    0,
+	"debug":    1,
+	"info":     2,
+	"notice":   2,
+	"warn":     3,
+	"warning":  3,
+	"error":    4,
+	"err":      4,
+	"fatal":    5,
+	"critical": 5,
+	"crit":     5,
+	"panic":    5,
+	"dpanic":   5,
+	"alert":    5,
+	"emerg":    5,
+}
+
+// levelKeys are the fields loggers put the level in.
+var levelKeys = []string{"level", "lvl", "severity", "log.level", "loglevel"}
+
+// LogFilter selects the lines of a log. Lines must contain Grep and match
+// Regex, or with Invert those that do are dropped. Level keeps lines of at
+// least that level, dropping lines without one. Until drops lines logged
+// after it, and Resume those a stream sent before it reconnected. The zero
+// LogFilter keeps every line.
+type LogFilter struct {
+	Grep   string
+	Regex  *regexp.Regexp
+	Invert bool
+	Level  string
+	Until  *time.Time
+	Resume *Resume
+}
+
+// Active reports whether the filter drops any lines.
+func (f LogFilter) Active() bool {
+	return f.Grep != "" || f.Regex != nil || f.Level != "" || f.Until != nil || f.Resume != nil
+}
+
+// Validate checks the level is one LogFilter knows.
+func (f LogFilter) Validate() error {
+	if _, ok := levels[strings.ToLower(f.Level)]; f.Level != "" && !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownLevel, f.Level)
+	}
+	return nil
+}
+
+// Match reports whether the filter keeps line.
+func (f LogFilter) Match(line LogLine) bool {
+	if f.Until != nil && line.Time.After(*f.Until) {
+		return false
+	}
+
+	if f.Grep != "" || f.Regex != nil {
+		matched := (f.Grep == "" || strings.Contains(line.Text, f.Grep)) &&
+			(f.Regex == nil || f.Regex.MatchString(line.Text))
+		if matched == f.Invert {
+			return false
+		}
+	}
+
+	if f.Level != "" {
+		rank, ok := levelRank(ParseFields(line.Text))
+		if !ok || rank < levels[strings.ToLower(f.Level)] {
+			return false
+		}
+	}
+
+	// Last, as the lines sent before were counted after the other checks.
+	return f.Resume == nil || !f.Resume.sent(line)
+}
+
+// levelRank ranks the level of parsed fields. Numeric levels are those of
+// pino and bunyan, 10 for trace up to 60 for fatal.
+func levelRank(fields map[string]interface{}) (int, bool) {
+	for _, key := range levelKeys {
+		switch value := fields[key].(type) {
+		case string:
+			rank, ok := levels[strings.ToLower(value)]
+			return rank, ok
+		case float64:
+			if value >= 10 && value <= 60 {
+				return int(value)/10 - 1, true
+			}
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// ParseFields parses a line logged as a JSON object or as logfmt
+// key=value pairs. It returns nil for other lines.
+func ParseFields(text string) map[string]interface{} {
+	text = strings.TrimSpace(text)
+	if strings.HasPrefix(text, "{") {
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(text), &fields); err == nil {
+			return fields
+		}
+		return nil
+	}
+	return parseLogfmt(text)
+}
+
+// parseLogfmt reads key=value pairs, separated by any whitespace, with
+// optionally quoted values. Words without a value are skipped. Plain text
+// often has a pair or two, so only lines with a level, message or time key
+// count as logfmt.
+func parseLogfmt(text string) map[string]interface{} {
+	fields := map[string]interface{}{}
+	for text != "" {
+		text = strings.TrimLeftFunc(text, unicode.IsSpace)
+		end := strings.IndexFunc(text, func(r rune) bool { return r == '=' || unicode.IsSpace(r) })
+		if end < 0 || text[end] != '=' {
+			// A bare word.
+			if end < 0 {
+				break
+			}
+			text = text[end:]
+			continue
+		}
+
+		key, rest := text[:end], text[end+1:]
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			// The first quote that isn't escaped closes the value; an
+			// escaped backslash doesn't escape it.
+			closing := 1
+			for closing < len(rest) && rest[closing] != '"' {
+				if rest[closing] == '\\' {
+					closing++
+				}
+				closing++
+			}
+			if closing >= len(rest) {
+				return nil
+			}
+			unquoted, err := strconv.Unquote(rest[:closing+1])
+			if err != nil {
+				return nil
+			}
+			value, text = unquoted, rest[closing+1:]
+		} else {
+			value, text = rest, ""
+			if space := strings.IndexFunc(rest, unicode.IsSpace); space >= 0 {
+				value, text = rest[:space], rest[space:]
+			}
+		}
+
+		if key != "" {
+			fields[key] = value
+		}
+	}
+
+	for _, keys := range [][]string{levelKeys, messageKeys, timeKeys} {
+		for _, key := range keys {
+			if _, ok := fields[key]; ok {
+				return fields
+			}
+		}
+	}
+	return nil
+}
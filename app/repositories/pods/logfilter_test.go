@@ -0,0 +1,60 @@
+package pods
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestParseFields(t *testing.T) {
+	tests := []struct {
+		text string
+		want map[string]interface{}
+	}{
+		{`level=info msg=started port=8080`, map[string]interface{}{"level": "info", "msg": "started", "port": "8080"}},
+		{"level=warn\tmsg=\"disk full\"  path=/var", map[string]interface{}{"level": "warn", "msg": "disk full", "path": "/var"}},
+		{`lvl=error msg="said \"no\"" done`, map[string]interface{}{"lvl": "error", "msg": `said "no"`}},
+		{`level=info path="C:\\" next=1`, map[string]interface{}{"level": "info", "path": `C:\`, "next": "1"}},
+		{`ts=2026-10-19T10:00:00Z msg=`, map[string]interface{}{"ts": "2026-10-19T10:00:00Z", "msg": ""}},
+		{`  {"level":"debug","msg":"hi","n":3}  `, map[string]interface{}{"level": "debug", "msg": "hi", "n": float64(3)}},
+		{`listening on a=b`, nil},
+		{`plain text`, nil},
+		{`level=info msg="unterminated`, nil},
+		{`{"level":`, nil},
+	}
+	for _, test := range tests {
+		if got := ParseFields(test.text); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseFields(%q) = %v; want %v", test.text, got, test.want)
+		}
+	}
+}
+
+func TestLogFilterMatch(t *testing.T) {
+	until := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		filter LogFilter
+		text   string
+		time   time.Time
+		want   bool
+	}{
+		{"zero", LogFilter{}, "anything", until, true},
+		{"grep", LogFilter{Grep: "timeout"}, "read timeout", until, true},
+		{"grep miss", LogFilter{Grep: "timeout"}, "ok", until, false},
+		{"invert", LogFilter{Grep: "health", Invert: true}, "GET /health", until, false},
+		{"regex", LogFilter{Regex: regexp.MustCompile(`5\d\d`)}, "status=503", until, true},
+		{"grep and regex", LogFilter{Grep: "GET", Regex: regexp.MustCompile(`5\d\d`)}, "POST 503", until, false},
+		{"level", LogFilter{Level: "warn"}, "level=error msg=x", until, true},
+		{"level below", LogFilter{Level: "warn"}, `{"level":"info"}`, until, false},
+		{"level numeric", LogFilter{Level: "error"}, `{"level":50}`, until, true},
+		{"level missing", LogFilter{Level: "debug"}, "plain", until, false},
+		{"until", LogFilter{Until: &until}, "x", until.Add(time.Second), false},
+	}
+	for _, test := range tests {
+		line := LogLine{Time: test.time, Text: test.text}
+		if got := test.filter.Match(line); got != test.want {
+			t.Errorf("%s: Match(%q) = %v; want %v", test.name, test.text, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,346 @@
+package pods
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chechetech/app/azure-go/repositories/cache"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+)
+
+// DefaultContainerAnnotation names the container kubectl reads the logs of
+// when none is given.
+const DefaultContainerAnnotation = "kubectl.kubernetes.io/default-container"
+
+// MaxLogSources is how many containers are read at once, like stern's
+// --max-log-requests; more would be a burden on the kubelets.
+const MaxLogSources = 50
+
+// ErrTooManySources is returned when a selector matches more than
+// MaxLogSources containers.
+var ErrTooManySources = fmt.Errorf("more than %d containers match, narrow the selector", MaxLogSources)
+
+// LogSource is a container whose logs are read.
+type LogSource struct {
+	Pod       string
+	Container string
+}
+
+// LogLine is a line a container logged, without its newline.
+type LogLine struct {
+	Source LogSource
+	Time   time.Time
+	Text   string
+}
+
+// GetPod gets a pod, from store when it has synced them.
+func GetPod(clientSet *kubernetes.Clientset, store *cache.Cache, namespace, name string) (*corev1.Pod, error) {
+	if lister, ok := store.Pods(namespace); ok {
+		pod, err := lister.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		return pod.DeepCopy(), nil
+	}
+	return clientSet.CoreV1().Pods(namespace).Get(context.Background(), name, metav1.GetOptions{})
+}
+
+// DefaultContainer is the container to read when none is given: the one
+// the default-container annotation names, otherwise the first.
+func DefaultContainer(pod *corev1.Pod) string {
+	if name := pod.Annotations[DefaultContainerAnnotation]; name != "" {
+		for _, container := range pod.Spec.Containers {
+			if container.Name == name {
+				return name
+			}
+		}
+	}
+	if len(pod.Spec.Containers) == 0 {
+		return ""
+	}
+	return pod.Spec.Containers[0].Name
+}
+
+// ContainerSources lists the containers of pod that have logs, init
+// containers first like `kubectl logs --all-containers`. With previous
+// only containers that restarted have logs.
+func ContainerSources(pod *corev1.Pod, previous bool) []LogSource {
+	var sources []LogSource
+	for _, statuses := range [][]corev1.ContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses} {
+		for _, status := range statuses {
+			if previous && status.LastTerminationState.Terminated == nil {
+				continue
+			}
+			if !previous && status.State.Running == nil && status.State.Terminated == nil {
+				continue
+			}
+			sources = append(sources, LogSource{Pod: pod.Name, Container: status.Name})
+		}
+	}
+	return sources
+}
+
+// PodSources lists the containers with logs of pods, only those named
+// container unless it is empty.
+func PodSources(pods []corev1.Pod, container string, previous bool) []LogSource {
+	var sources []LogSource
+	for i := range pods {
+		for _, source := range ContainerSources(&pods[i], previous) {
+			if container == "" || source.Container == container {
+				sources = append(sources, source)
+			}
+		}
+	}
+	return sources
+}
+
+// ReadLogs reads the lines of sources that filter keeps and merges them by
+// time. options apply to each source; timestamps are always requested to
+// merge by.
+func ReadLogs(ctx context.Context, clientSet *kubernetes.Clientset, namespace string, sources []LogSource, options corev1.PodLogOptions, filter LogFilter) ([]LogLine, error) {
+	options.Follow, options.Timestamps = false, true
+
+	results := make([][]LogLine, len(sources))
+	errs := make([]error, len(sources))
+	var wg sync.WaitGroup
+	for i, source := range sources {
+		wg.Add(1)
+		go func(i int, source LogSource) {
+			defer wg.Done()
+			stream, err := openLogs(ctx, clientSet, namespace, source, options)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer stream.Close()
+			errs[i] = readLines(stream, source, func(line LogLine) bool {
+				if filter.Match(line) {
+					results[i] = append(results[i], line)
+				}
+				return true
+			})
+		}(i, source)
+	}
+	wg.Wait()
+
+	var lines []LogLine
+	for i := range sources {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		lines = append(lines, results[i]...)
+	}
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].Time.Before(lines[j].Time) })
+	return lines, nil
+}
+
+// FollowLogs follows the logs of sources, sending the lines filter keeps as
+// they are logged until ctx ends or every stream is closed; the channel is
+// closed then.
+// Streams are opened before it returns, so an error opening one is
+// returned rather than lost.
+func FollowLogs(ctx context.Context, clientSet *kubernetes.Clientset, namespace string, sources []LogSource, options corev1.PodLogOptions, filter LogFilter) (<-chan LogLine, error) {
+	options.Follow, options.Timestamps = true, true
+
+	var streams []io.ReadCloser
+	for _, source := range sources {
+		stream, err := openLogs(ctx, clientSet, namespace, source, options)
+		if err != nil {
+			for _, opened := range streams {
+				opened.Close()
+			}
+			return nil, err
+		}
+		streams = append(streams, stream)
+	}
+
+	lines := make(chan LogLine)
+	var wg sync.WaitGroup
+	for i, stream := range streams {
+		wg.Add(1)
+		go func(stream io.ReadCloser, source LogSource) {
+			defer wg.Done()
+			defer stream.Close()
+			err := readLines(stream, source, func(line LogLine) bool {
+				if !filter.Match(line) {
+					return true
+				}
+				select {
+				case lines <- line:
+					return true
+				case <-ctx.Done():
+					return false
+				}
+			})
+			if err != nil && ctx.Err() == nil {
+				fmt.Printf("Error following logs of %s/%s: %v\n", source.Pod, source.Container, err)
+			}
+		}(stream, sources[i])
+	}
+
+	go func() {
+		wg.Wait()
+		close(lines)
+	}()
+	return lines, nil
+}
+
+// FollowPods follows the logs of the pods match accepts, like FollowLogs,
+// and also of pods that appear later and containers that restart, which
+// are read from their first line. container limits it to containers of
+// that name. The channel is closed once ctx ends.
+func (w *Watcher) FollowPods(ctx context.Context, clientSet *kubernetes.Clientset, namespace string, match func(*corev1.Pod) bool, container string, options corev1.PodLogOptions, filter LogFilter) (<-chan LogLine, error) {
+	subscription, err := w.Subscribe(ctx, namespace, "")
+	if err != nil {
+		return nil, err
+	}
+
+	options.Follow, options.Timestamps, options.Previous = true, true, false
+	fresh := options
+	fresh.TailLines, fresh.SinceSeconds, fresh.SinceTime = nil, nil, nil
+
+	lines := make(chan LogLine)
+	var wg sync.WaitGroup
+	// Each instance of a container is followed once; its ID changes when
+	// it restarts.
+	followed := map[string]bool{}
+
+	follow := func(pod *corev1.Pod, options corev1.PodLogOptions) {
+		if !match(pod) {
+			return
+		}
+		for _, statuses := range [][]corev1.ContainerStatus{pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses} {
+			for _, status := range statuses {
+				if container != "" && status.Name != container {
+					continue
+				}
+				if status.ContainerID == "" || followed[status.ContainerID] || (status.State.Running == nil && status.State.Terminated == nil) {
+					continue
+				}
+				followed[status.ContainerID] = true
+
+				wg.Add(1)
+				go func(source LogSource) {
+					defer wg.Done()
+					stream, err := openLogs(ctx, clientSet, namespace, source, options)
+					if err != nil {
+						fmt.Printf("Error following logs of %s/%s: %v\n", source.Pod, source.Container, err)
+						return
+					}
+					defer stream.Close()
+					readLines(stream, source, func(line LogLine) bool {
+						if !filter.Match(line) {
+							return true
+						}
+						select {
+						case lines <- line:
+							return true
+						case <-ctx.Done():
+							return false
+						}
+					})
+				}(LogSource{Pod: pod.Name, Container: status.Name})
+			}
+		}
+	}
+
+	var matching []corev1.Pod
+	for _, pod := range subscription.Snapshot {
+		if match(pod) {
+			matching = append(matching, *pod)
+		}
+	}
+	if len(PodSources(matching, container, false)) > MaxLogSources {
+		return nil, ErrTooManySources
+	}
+	for _, pod := range subscription.Snapshot {
+		follow(pod, options)
+	}
+
+	go func() {
+		defer func() {
+			wg.Wait()
+			close(lines)
+		}()
+
+		events, version := subscription.Events, subscription.Version
+		for {
+			var event WatchEvent
+			var ok bool
+			select {
+			case event, ok = <-events:
+			case <-ctx.Done():
+				return
+			}
+
+			if !ok {
+				// Dropped for falling behind; carry on from the last event.
+				resumed, err := w.Subscribe(ctx, namespace, version)
+				if err != nil {
+					return
+				}
+				for _, pod := range resumed.Snapshot {
+					follow(pod, fresh)
+				}
+				for _, event := range resumed.Replay {
+					if event.Type != watch.Deleted {
+						follow(event.Pod, fresh)
+					}
+				}
+				events, version = resumed.Events, resumed.Version
+				continue
+			}
+
+			version = event.ResourceVersion
+			if event.Type != watch.Deleted {
+				follow(event.Pod, fresh)
+			}
+		}
+	}()
+
+	return lines, nil
+}
+
+func openLogs(ctx context.Context, clientSet *kubernetes.Clientset, namespace string, source LogSource, options corev1.PodLogOptions) (io.ReadCloser, error) {
+	options.Container = source.Container
+	stream, err := clientSet.CoreV1().Pods(namespace).GetLogs(source.Pod, &options).Stream(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("container %s: %w", source.Container, err)
+	}
+	return stream, nil
+}
+
+// readLines splits a stream requested with timestamps into lines, until it
+// ends or handle returns false.
+func readLines(stream io.Reader, source LogSource, handle func(LogLine) bool) error {
+	reader := bufio.NewReader(stream)
+	for {
+		text, err := reader.ReadString('\n')
+		if text != "" {
+			line := LogLine{Source: source, Text: strings.TrimSuffix(text, "\n")}
+			if stamp, rest, ok := strings.Cut(line.Text, " "); ok {
+				if parsed, parseErr := time.Parse(time.RFC3339Nano, stamp); parseErr == nil {
+					line.Time, line.Text = parsed, rest
+				}
+			}
+			if !handle(line) {
+				return nil
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
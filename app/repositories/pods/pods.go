@@ -1,63 +1,173 @@
 package pods
 
 import (
+	"bufio"
 	"context"
-	"io"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
 	"time"
 
+	"github.com/chechetech/app/azure-go/repositories/cache"
+	"github.com/chechetech/app/azure-go/repositories/deployments"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 )
 
-func GetPods(clientSet *kubernetes.Clientset, namespace string) (*corev1.PodList, error) {
+// ErrInvalidFilter is returned for selectors GetPods can't parse.
+var ErrInvalidFilter = errors.New("invalid filter")
 
-	pods, err := clientSet.CoreV1().Pods(namespace).List(context.Background(), metav1.ListOptions{})
+// Filter narrows the pods GetPods lists. The selectors, Limit and Continue
+// are passed to the API server; Deployment and NamePrefix are applied to
+// each page it returns, so a page can hold fewer than Limit pods.
+type Filter struct {
+	LabelSelector string
+	FieldSelector string
+	// Deployment keeps the pods of the deployment's ReplicaSets.
+	Deployment string
+	NamePrefix string
+	Limit      int64
+	Continue   string
+}
+
+// GetPods lists a page of the pods of namespace that match filter. The
+// list's Continue is the token for the next page, or "" after the last.
+// Unpaged lists come from store when it has synced the pods and can match
+// the field selector.
+func GetPods(clientSet *kubernetes.Clientset, store *cache.Cache, namespace string, filter Filter) (*corev1.PodList, error) {
+	labelSelector, err := labels.Parse(filter.LabelSelector)
+	if err != nil {
+		return nil, fmt.Errorf("%w: labelSelector: %v", ErrInvalidFilter, err)
+	}
+	fieldSelector, err := fields.ParseSelector(filter.FieldSelector)
+	if err != nil {
+		return nil, fmt.Errorf("%w: fieldSelector: %v", ErrInvalidFilter, err)
+	}
+
+	// The deployment's selector narrows the list on the server; ownership
+	// is checked below since other controllers can match it too.
+	var owners map[types.UID]bool
+	if filter.Deployment != "" {
+		deployment, err := deployments.GetDeployment(clientSet, store, namespace, filter.Deployment)
+		if err != nil {
+			return nil, err
+		}
+		selector, err := metav1.LabelSelectorAsSelector(deployment.Spec.Selector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector: %w", err)
+		}
+		if requirements, selectable := selector.Requirements(); selectable {
+			labelSelector = labelSelector.Add(requirements...)
+		}
+
+		replicaSets, err := deployments.GetReplicaSets(clientSet, store, deployment)
+		if err != nil {
+			return nil, err
+		}
+		owners = map[types.UID]bool{}
+		for _, replicaSet := range replicaSets {
+			owners[replicaSet.UID] = true
+		}
+	}
+
+	pods, err := listPods(clientSet, store, namespace, labelSelector, fieldSelector, filter)
 	if err != nil {
 		return nil, err
 	}
 
+	matching := pods.Items[:0]
+	for _, pod := range pods.Items {
+		if !strings.HasPrefix(pod.Name, filter.NamePrefix) {
+			continue
+		}
+		if owners != nil {
+			if owner := metav1.GetControllerOf(&pod); owner == nil || !owners[owner.UID] {
+				continue
+			}
+		}
+		matching = append(matching, pod)
+	}
+	pods.Items = matching
+
 	return pods, nil
+}
+
+// listPods lists the pods matching the selectors, from store when it can.
+func listPods(clientSet *kubernetes.Clientset, store *cache.Cache, namespace string, labelSelector labels.Selector, fieldSelector fields.Selector, filter Filter) (*corev1.PodList, error) {
+	if lister, ok := store.Pods(namespace); ok && filter.Limit == 0 && filter.Continue == "" && cacheSelectable(fieldSelector) {
+		cached, err := lister.List(labelSelector)
+		if err != nil {
+			return nil, err
+		}
+		pods := &corev1.PodList{}
+		for _, pod := range cached {
+			if fieldSelector.Matches(podFields(pod)) {
+				pods.Items = append(pods.Items, *pod)
+			}
+		}
+		sort.Slice(pods.Items, func(i, j int) bool { return pods.Items[i].Name < pods.Items[j].Name })
+		return pods, nil
+	}
+
+	return clientSet.CoreV1().Pods(namespace).List(context.Background(), metav1.ListOptions{
+		LabelSelector: labelSelector.String(),
+		FieldSelector: fieldSelector.String(),
+		Limit:         filter.Limit,
+		Continue:      filter.Continue,
+	})
+}
 
+// podFields are the fields of a pod that field selectors are matched
+// against in the cache; selectors on other fields go to the API server.
+func podFields(pod *corev1.Pod) fields.Set {
+	return fields.Set{
+		"metadata.name":           pod.Name,
+		"metadata.namespace":      pod.Namespace,
+		"spec.nodeName":           pod.Spec.NodeName,
+		"spec.restartPolicy":      string(pod.Spec.RestartPolicy),
+		"spec.serviceAccountName": pod.Spec.ServiceAccountName,
+		"status.phase":            string(pod.Status.Phase),
+		"status.podIP":            pod.Status.PodIP,
+	}
 }
 
-func GetPodLogs(clientSet *kubernetes.Clientset, namespace string, podName string, follow bool, sinceSeconds *int64, sinceTime *metav1.Time, timestamps bool, tailLines *int64, bufferSize int64) (io.ReadCloser, string, error) {
+func cacheSelectable(selector fields.Selector) bool {
+	selectable := podFields(&corev1.Pod{})
+	for _, requirement := range selector.Requirements() {
+		if _, ok := selectable[requirement.Field]; !ok {
+			return false
+		}
+	}
+	return true
+}
 
+// CountLogLines counts the lines a container of a pod logged since since
+// that match pattern. An empty container means the pod's only container.
+func CountLogLines(clientSet *kubernetes.Clientset, namespace, podName, container string, since time.Time, pattern *regexp.Regexp) (int, error) {
 	podLogOptions := corev1.PodLogOptions{
-		Follow:       follow,
-		SinceSeconds: sinceSeconds,
-		SinceTime:    sinceTime,
-		Timestamps:   timestamps,
-		TailLines:    tailLines,
+		Container: container,
+		SinceTime: &metav1.Time{Time: since},
 	}
 
-	podLogRequest := clientSet.CoreV1().Pods(namespace).GetLogs(podName, &podLogOptions)
-	stream, err := podLogRequest.Stream(context.TODO())
+	stream, err := clientSet.CoreV1().Pods(namespace).GetLogs(podName, &podLogOptions).Stream(context.TODO())
 	if err != nil {
-		return nil, "", err
-	}
-
-	if follow {
-		return stream, "", nil
+		return 0, err
 	}
 	defer stream.Close()
 
-	var logs string
-	buf := make([]byte, bufferSize)
-	for {
-		numBytes, err := stream.Read(buf)
-		if err == io.EOF {
-			break
-		}
-		if numBytes == 0 {
-			time.Sleep(time.Second)
-			continue
-		}
-		if err != nil {
-			return nil, "", err
+	count := 0
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if pattern.Match(scanner.Bytes()) {
+			count++
 		}
-		message := string(buf[:numBytes])
-		logs += message
 	}
-	return nil, logs, nil
+	return count, scanner.Err()
 }
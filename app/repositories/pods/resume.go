@@ -0,0 +1,182 @@
+package pods
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogPosition is how far a stream got in the log of a source: the time of
+// the last line it sent, and how many of the lines it sent had that time.
+type LogPosition struct {
+	Time  time.Time
+	Lines int
+}
+
+// LogCursor is how far a stream got in the logs it follows. The lines of
+// several containers don't arrive in time order, so each source has its
+// own position. Sources without one carry on from Default, or when that is
+// nil from the earliest position, since they sent nothing before it.
+type LogCursor struct {
+	Default   *LogPosition
+	Positions map[LogSource]LogPosition
+}
+
+// ParseLogCursor reads a cursor as String writes it: space-separated
+// pod/container=time tokens, where time is RFC 3339 followed by #lines
+// when more than one line had it. A token that is only a time is the
+// Default.
+func ParseLogCursor(s string) (LogCursor, error) {
+	cursor := LogCursor{Positions: map[LogSource]LogPosition{}}
+	for _, token := range strings.Fields(s) {
+		name, value, ok := strings.Cut(token, "=")
+		if !ok {
+			name, value = "", token
+		}
+
+		position, err := parseLogPosition(value)
+		if err != nil {
+			return cursor, err
+		}
+
+		if name == "" {
+			cursor.Default = &position
+			continue
+		}
+		pod, container, ok := strings.Cut(name, "/")
+		if !ok || pod == "" || container == "" {
+			return cursor, fmt.Errorf("%q is not a pod/container", name)
+		}
+		cursor.Positions[LogSource{Pod: pod, Container: container}] = position
+	}
+	return cursor, nil
+}
+
+func parseLogPosition(s string) (LogPosition, error) {
+	stamp, lines, counted := strings.Cut(s, "#")
+	position := LogPosition{Lines: 1}
+	var err error
+	if position.Time, err = time.Parse(time.RFC3339Nano, stamp); err != nil {
+		return position, err
+	}
+	if counted {
+		if position.Lines, err = strconv.Atoi(lines); err != nil || position.Lines < 1 {
+			return position, errors.New("the line count after # must be a positive number")
+		}
+	}
+	return position, nil
+}
+
+// Empty reports whether the cursor has no positions.
+func (c LogCursor) Empty() bool {
+	return c.Default == nil && len(c.Positions) == 0
+}
+
+// Since is the earliest time a stream resuming from the cursor reads from.
+func (c LogCursor) Since() time.Time {
+	var since time.Time
+	if c.Default != nil {
+		since = c.Default.Time
+	}
+	for _, position := range c.Positions {
+		if since.IsZero() || position.Time.Before(since) {
+			since = position.Time
+		}
+	}
+	return since
+}
+
+// position is where source carries on from.
+func (c LogCursor) position(source LogSource) LogPosition {
+	if position, ok := c.Positions[source]; ok {
+		return position
+	}
+	if c.Default != nil {
+		return *c.Default
+	}
+	return LogPosition{Time: c.Since()}
+}
+
+// Copy returns a cursor that advances independently of c.
+func (c LogCursor) Copy() LogCursor {
+	copied := LogCursor{Default: c.Default, Positions: make(map[LogSource]LogPosition, len(c.Positions))}
+	for source, position := range c.Positions {
+		copied.Positions[source] = position
+	}
+	return copied
+}
+
+// Advance moves the position of the source of line to it. Lines without a
+// time leave it where it is.
+func (c LogCursor) Advance(line LogLine) {
+	if line.Time.IsZero() {
+		return
+	}
+	position := c.Positions[line.Source]
+	if line.Time.Equal(position.Time) {
+		position.Lines++
+	} else {
+		position = LogPosition{Time: line.Time, Lines: 1}
+	}
+	c.Positions[line.Source] = position
+}
+
+func (c LogCursor) String() string {
+	var tokens []string
+	if c.Default != nil {
+		tokens = append(tokens, formatLogPosition(*c.Default))
+	}
+	for source, position := range c.Positions {
+		tokens = append(tokens, source.Pod+"/"+source.Container+"="+formatLogPosition(position))
+	}
+	sort.Strings(tokens)
+	return strings.Join(tokens, " ")
+}
+
+func formatLogPosition(position LogPosition) string {
+	s := position.Time.UTC().Format(time.RFC3339Nano)
+	if position.Lines > 1 {
+		s += "#" + strconv.Itoa(position.Lines)
+	}
+	return s
+}
+
+// Resume skips the lines a stream sent before it reconnected: those of each
+// source up to its position in the cursor.
+type Resume struct {
+	cursor LogCursor
+
+	mu sync.Mutex
+	// skipped counts the lines of each source that had the time of its
+	// position.
+	skipped map[LogSource]int
+}
+
+func NewResume(cursor LogCursor) *Resume {
+	return &Resume{cursor: cursor.Copy(), skipped: map[LogSource]int{}}
+}
+
+// Cursor returns a copy of the cursor the stream resumes from.
+func (r *Resume) Cursor() LogCursor {
+	return r.cursor.Copy()
+}
+
+// sent reports whether line was sent before the stream reconnected.
+func (r *Resume) sent(line LogLine) bool {
+	position := r.cursor.position(line.Source)
+	switch {
+	case line.Time.After(position.Time):
+		return false
+	case line.Time.Before(position.Time):
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.skipped[line.Source]++
+	return r.skipped[line.Source] <= position.Lines
+}
@@ -0,0 +1,107 @@
+package pods
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLogCursor(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"", ""},
+		{"2026-10-19T10:00:00Z", "2026-10-19T10:00:00Z"},
+		{"api-1/api=2026-10-19T10:00:00.5Z#3", "api-1/api=2026-10-19T10:00:00.5Z#3"},
+		{"api-1/api=2026-10-19T10:00:00Z#1", "api-1/api=2026-10-19T10:00:00Z"},
+		{"api-2/api=2026-10-19T13:00:00+03:00  api-1/proxy=2026-10-19T09:00:00Z", "api-1/proxy=2026-10-19T09:00:00Z api-2/api=2026-10-19T10:00:00Z"},
+	}
+	for _, test := range tests {
+		cursor, err := ParseLogCursor(test.in)
+		if err != nil {
+			t.Errorf("ParseLogCursor(%q): %v", test.in, err)
+			continue
+		}
+		if got := cursor.String(); got != test.want {
+			t.Errorf("ParseLogCursor(%q).String() = %q; want %q", test.in, got, test.want)
+		}
+	}
+
+	for _, in := range []string{
+		"yesterday",
+		"api-1=2026-10-19T10:00:00Z",
+		"/api=2026-10-19T10:00:00Z",
+		"api-1/api=2026-10-19T10:00:00Z#0",
+		"api-1/api=2026-10-19T10:00:00Z#x",
+	} {
+		if _, err := ParseLogCursor(in); err == nil {
+			t.Errorf("ParseLogCursor(%q) should fail", in)
+		}
+	}
+}
+
+func TestLogCursorSince(t *testing.T) {
+	cursor, err := ParseLogCursor("2026-10-19T11:00:00Z a/x=2026-10-19T10:00:00Z b/x=2026-10-19T12:00:00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC); !cursor.Since().Equal(want) {
+		t.Errorf("Since() = %s; want %s", cursor.Since(), want)
+	}
+}
+
+func TestLogCursorAdvance(t *testing.T) {
+	cursor := LogCursor{Positions: map[LogSource]LogPosition{}}
+	at := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	a, b := LogSource{Pod: "a", Container: "x"}, LogSource{Pod: "b", Container: "x"}
+
+	cursor.Advance(LogLine{Source: a, Time: at})
+	cursor.Advance(LogLine{Source: a, Time: at})
+	cursor.Advance(LogLine{Source: b, Time: at.Add(-time.Hour)})
+	cursor.Advance(LogLine{Source: b})
+
+	want := "a/x=2026-10-19T10:00:00Z#2 b/x=2026-10-19T09:00:00Z"
+	if got := cursor.String(); got != want {
+		t.Errorf("String() = %q; want %q", got, want)
+	}
+}
+
+func TestResumeSent(t *testing.T) {
+	cursor, err := ParseLogCursor("a/x=2026-10-19T10:00:00Z#2 b/x=2026-10-19T12:00:00Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resume := NewResume(cursor)
+	at := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	a, b, c := LogSource{Pod: "a", Container: "x"}, LogSource{Pod: "b", Container: "x"}, LogSource{Pod: "c", Container: "x"}
+
+	tests := []struct {
+		line LogLine
+		sent bool
+	}{
+		{LogLine{Source: a, Time: at.Add(-time.Second)}, true},
+		{LogLine{Source: a, Time: at}, true},
+		{LogLine{Source: a, Time: at}, true},
+		// A third line with the same time wasn't sent yet.
+		{LogLine{Source: a, Time: at}, false},
+		{LogLine{Source: a, Time: at.Add(time.Second)}, false},
+		// b got further than a.
+		{LogLine{Source: b, Time: at.Add(time.Hour)}, true},
+		{LogLine{Source: b, Time: at.Add(3 * time.Hour)}, false},
+		// c sent nothing, so it carries on from the earliest position.
+		{LogLine{Source: c, Time: at.Add(-time.Second)}, true},
+		{LogLine{Source: c, Time: at.Add(time.Second)}, false},
+	}
+	for i, test := range tests {
+		if got := resume.sent(test.line); got != test.sent {
+			t.Errorf("line %d: sent(%s %s) = %v; want %v", i, test.line.Source.Pod, test.line.Time.Format(time.RFC3339), got, test.sent)
+		}
+	}
+
+	// The cursor handed out is a copy.
+	copied := resume.Cursor()
+	copied.Advance(LogLine{Source: a, Time: at.Add(time.Hour)})
+	if got := resume.Cursor().String(); got != cursor.String() {
+		t.Errorf("Cursor() was changed to %q", got)
+	}
+}
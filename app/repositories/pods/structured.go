@@ -0,0 +1,79 @@
+package pods
+
+import (
+	"strings"
+	"time"
+)
+
+// levelNames name the level ranks, for loggers that log numbers.
+var levelNames = []string{"trace", "debug", "info", "warn", "error", "fatal"}
+
+var (
+	messageKeys = []string{"msg", "message", "@message"}
+	timeKeys    = []string{"time", "ts", "timestamp", "@timestamp"}
+)
+
+// LogEntry is a line parsed into columns. Fields holds what isn't a
+// column; a line that is neither JSON nor logfmt only has Raw.
+type LogEntry struct {
+	Timestamp time.Time              `json:"timestamp"`
+	Pod       string                 `json:"pod"`
+	Container string                 `json:"container"`
+	Level     string                 `json:"level,omitempty"`
+	Message   string                 `json:"message,omitempty"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+	Raw       string                 `json:"raw,omitempty"`
+}
+
+// ParseEntry parses a line logged as JSON or logfmt. The timestamp is the
+// one the line logged if it is RFC 3339, otherwise when the container
+// wrote it.
+func ParseEntry(line LogLine) LogEntry {
+	entry := LogEntry{Timestamp: line.Time, Pod: line.Source.Pod, Container: line.Source.Container}
+
+	fields := ParseFields(line.Text)
+	if fields == nil {
+		entry.Raw = line.Text
+		return entry
+	}
+
+	for _, key := range levelKeys {
+		switch value := fields[key].(type) {
+		case string:
+			entry.Level = strings.ToLower(value)
+		case float64:
+			// Numbers as in levelRank.
+			if value < 10 || value > 60 {
+				continue
+			}
+			entry.Level = levelNames[int(value)/10-1]
+		default:
+			continue
+		}
+		delete(fields, key)
+		break
+	}
+
+	for _, key := range messageKeys {
+		if value, ok := fields[key].(string); ok {
+			entry.Message = value
+			delete(fields, key)
+			break
+		}
+	}
+
+	for _, key := range timeKeys {
+		if value, ok := fields[key].(string); ok {
+			if logged, err := time.Parse(time.RFC3339Nano, value); err == nil {
+				entry.Timestamp = logged
+				delete(fields, key)
+				break
+			}
+		}
+	}
+
+	if len(fields) > 0 {
+		entry.Fields = fields
+	}
+	return entry
+}
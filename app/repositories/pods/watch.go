@@ -0,0 +1,189 @@
+package pods
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/chechetech/app/azure-go/repositories/cache"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	toolscache "k8s.io/client-go/tools/cache"
+)
+
+const (
+	// watchHistory is how many events of a namespace are kept for clients
+	// resuming a watch.
+	watchHistory = 1000
+	// watchBuffer is how far a subscriber can fall behind before it is
+	// dropped; it can resume from the last event it got.
+	watchBuffer = 256
+)
+
+// WatchEvent is a change to a pod. ResourceVersion is the pod's version
+// after the change and identifies the event when resuming.
+type WatchEvent struct {
+	Type            watch.EventType
+	ResourceVersion string
+	Pod             *corev1.Pod
+}
+
+// Watcher shares the pod informer of the cache between every client
+// watching a namespace, so the API server sees a single watch however many
+// dashboards are open.
+type Watcher struct {
+	store *cache.Cache
+
+	mu         sync.Mutex
+	namespaces map[string]*namespaceWatch
+}
+
+type namespaceWatch struct {
+	informer    toolscache.SharedIndexInformer
+	events      []WatchEvent
+	subscribers map[chan WatchEvent]bool
+}
+
+// Subscription is a client's view of a namespace. When it couldn't resume
+// from the version asked for, Snapshot holds every pod instead of Replay
+// holding the events missed. Events is closed when the context ends or the
+// client falls too far behind.
+type Subscription struct {
+	Resumed  bool
+	Snapshot []*corev1.Pod
+	Replay   []WatchEvent
+	// Version is the resource version of the snapshot or the last replayed
+	// event.
+	Version string
+	Events  <-chan WatchEvent
+}
+
+func NewWatcher(store *cache.Cache) *Watcher {
+	return &Watcher{
+		store:      store,
+		namespaces: map[string]*namespaceWatch{},
+	}
+}
+
+// Subscribe starts watching the pods of namespace until ctx ends, resuming
+// after the event with resourceVersion if it is still kept. The informer of
+// the namespace is started by its first reader.
+func (w *Watcher) Subscribe(ctx context.Context, namespace, resourceVersion string) (*Subscription, error) {
+	nw := w.namespace(namespace)
+	if !toolscache.WaitForCacheSync(ctx.Done(), nw.informer.HasSynced) {
+		return nil, ctx.Err()
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	subscription := &Subscription{}
+	if resourceVersion != "" {
+		for i := len(nw.events) - 1; i >= 0; i-- {
+			if nw.events[i].ResourceVersion == resourceVersion {
+				subscription.Resumed = true
+				subscription.Replay = append([]WatchEvent{}, nw.events[i+1:]...)
+				break
+			}
+		}
+	}
+
+	switch {
+	case !subscription.Resumed:
+		for _, obj := range nw.informer.GetStore().List() {
+			subscription.Snapshot = append(subscription.Snapshot, obj.(*corev1.Pod))
+		}
+		sort.Slice(subscription.Snapshot, func(i, j int) bool {
+			return subscription.Snapshot[i].Name < subscription.Snapshot[j].Name
+		})
+		subscription.Version = nw.informer.LastSyncResourceVersion()
+		if len(nw.events) > 0 {
+			subscription.Version = nw.events[len(nw.events)-1].ResourceVersion
+		}
+	case len(subscription.Replay) > 0:
+		subscription.Version = subscription.Replay[len(subscription.Replay)-1].ResourceVersion
+	default:
+		subscription.Version = resourceVersion
+	}
+
+	events := make(chan WatchEvent, watchBuffer)
+	nw.subscribers[events] = true
+	subscription.Events = events
+
+	go func() {
+		<-ctx.Done()
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if nw.subscribers[events] {
+			delete(nw.subscribers, events)
+			close(events)
+		}
+	}()
+
+	return subscription, nil
+}
+
+// namespace returns the watch of namespace, subscribing to its informer
+// the first time.
+func (w *Watcher) namespace(namespace string) *namespaceWatch {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if nw, ok := w.namespaces[namespace]; ok {
+		return nw
+	}
+
+	nw := &namespaceWatch{
+		informer:    w.store.PodInformer(namespace),
+		subscribers: map[chan WatchEvent]bool{},
+	}
+	nw.informer.AddEventHandler(toolscache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(obj interface{}, isInInitialList bool) {
+			// Subscribers get the pods already there as their snapshot.
+			if !isInInitialList {
+				w.dispatch(nw, watch.Added, obj)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			// Relists repeat pods that didn't change.
+			if oldObj.(*corev1.Pod).ResourceVersion != newObj.(*corev1.Pod).ResourceVersion {
+				w.dispatch(nw, watch.Modified, newObj)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(toolscache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			w.dispatch(nw, watch.Deleted, obj)
+		},
+	})
+	w.namespaces[namespace] = nw
+	return nw
+}
+
+// dispatch keeps an event for resuming clients and sends it to the
+// subscribers, dropping those that aren't keeping up.
+func (w *Watcher) dispatch(nw *namespaceWatch, eventType watch.EventType, obj interface{}) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return
+	}
+	event := WatchEvent{Type: eventType, ResourceVersion: pod.ResourceVersion, Pod: pod}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	nw.events = append(nw.events, event)
+	if len(nw.events) > watchHistory {
+		nw.events = nw.events[len(nw.events)-watchHistory:]
+	}
+
+	for subscriber := range nw.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			delete(nw.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
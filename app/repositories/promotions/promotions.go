@@ -0,0 +1,144 @@
+package promotions
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/chechetech/app/azure-go/config"
+	"github.com/chechetech/app/azure-go/repositories/deployments"
+	"github.com/chechetech/app/azure-go/repositories/registries"
+	"k8s.io/client-go/kubernetes"
+)
+
+var (
+	// ErrInvalid is returned for promotions that can never work, such as
+	// ones to an unknown environment.
+	ErrInvalid = errors.New("invalid promotion")
+	// ErrNoDigest is returned when the digest a source deployment runs
+	// can't be told, as for tag-only images before a pod has pulled them or
+	// while a rollout is mixing them.
+	ErrNoDigest = errors.New("source has no single known digest")
+)
+
+// Promotion takes the exact image a deployment runs to the deployment of
+// another environment.
+type Promotion struct {
+	Source           registries.Target `json:"source"`
+	SourceRepository string            `json:"sourceRepository"`
+	Environment      string            `json:"environment"`
+	Target           registries.Target `json:"target"`
+	TargetRepository string            `json:"targetRepository"`
+	// Image is the source image pinned to its digest. It is deployed as is
+	// rather than rebuilt from the target repository, so what was tested is
+	// what goes live.
+	Image  string `json:"image"`
+	Tag    string `json:"tag,omitempty"`
+	Digest string `json:"digest"`
+}
+
+// Plan finds what promoting a container of a deployment to environment
+// would deploy, and where. The target is resolved from the source
+// repository with its environment segment swapped, through the same
+// mappings and naming convention as registry webhooks.
+func Plan(clientset *kubernetes.Clientset, cfg *config.Config, namespace, deployment, container, environment string) (Promotion, error) {
+	environments := cfg.EnvironmentNames()
+	if !contains(environments, environment) {
+		return Promotion{}, fmt.Errorf("%w: unknown environment %q, expected one of %s", ErrInvalid, environment, strings.Join(environments, ", "))
+	}
+
+	running, err := registries.GetDeploymentImage(clientset, namespace, deployment, container)
+	if err != nil {
+		return Promotion{}, err
+	}
+	if running.Digest == "" {
+		if running.Digest, err = runningDigest(clientset, namespace, deployment, running.Container); err != nil {
+			return Promotion{}, err
+		}
+	}
+
+	host, repository, _, _ := registries.ParseImage(running.Image)
+	segments := strings.Split(repository, "/")
+	found := false
+	for i := len(segments) - 1; i >= 0 && !found; i-- {
+		if contains(environments, segments[i]) {
+			segments[i], found = environment, true
+		}
+	}
+	if !found {
+		return Promotion{}, fmt.Errorf("%w: repository %q has no environment segment", ErrInvalid, repository)
+	}
+
+	promotion := Promotion{
+		Source:           registries.Target{Namespace: namespace, Deployment: deployment, Container: running.Container},
+		SourceRepository: repository,
+		Environment:      environment,
+		TargetRepository: strings.Join(segments, "/"),
+		Tag:              running.Tag,
+		Digest:           running.Digest,
+	}
+	if promotion.TargetRepository == promotion.SourceRepository {
+		return Promotion{}, fmt.Errorf("%w: %s/%s is already in %s", ErrInvalid, namespace, deployment, environment)
+	}
+
+	if promotion.Target, _, err = registries.ResolveTarget(cfg, promotion.TargetRepository); err != nil {
+		return Promotion{}, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+
+	if promotion.Image, err = registries.ImagePath(host, repository, running.Tag, running.Digest, config.ImageRefTagDigest); err != nil {
+		return Promotion{}, err
+	}
+
+	return promotion, nil
+}
+
+// runningDigest reads the digest from the image IDs the kubelet reports for
+// the pods of the current ReplicaSet. They must all agree, otherwise the
+// deployment is mid-rollout and there is no single image to promote.
+func runningDigest(clientset *kubernetes.Clientset, namespace, name, container string) (string, error) {
+	deployment, err := deployments.GetDeployment(clientset, nil, namespace, name)
+	if err != nil {
+		return "", fmt.Errorf("failed to get deployment: %w", err)
+	}
+
+	replicaSets, err := deployments.GetReplicaSets(clientset, nil, deployment)
+	if err != nil {
+		return "", err
+	}
+	if len(replicaSets) == 0 {
+		return "", ErrNoDigest
+	}
+
+	pods, err := deployments.GetDeploymentPods(clientset, nil, deployment, replicaSets[:1])
+	if err != nil {
+		return "", err
+	}
+
+	digest := ""
+	for _, pod := range pods {
+		for _, status := range pod.Status.ContainerStatuses {
+			i := strings.LastIndex(status.ImageID, "@")
+			if status.Name != container || i < 0 {
+				continue
+			}
+			if digest != "" && digest != status.ImageID[i+1:] {
+				return "", fmt.Errorf("%w: pods of %s run different digests, wait for the rollout to finish", ErrNoDigest, name)
+			}
+			digest = status.ImageID[i+1:]
+		}
+	}
+
+	if digest == "" {
+		return "", ErrNoDigest
+	}
+	return digest, nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
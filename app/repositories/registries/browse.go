@@ -0,0 +1,80 @@
+package registries
+
+import (
+	"github.com/chechetech/app/azure-go/repositories/semver"
+	appsv1 "k8s.io/api/apps/v1"
+)
+
+// Deployed is a container of a deployment that runs an image of a browsed
+// repository. Behind is set when the repository has a newer release tag.
+type Deployed struct {
+	Namespace  string `json:"namespace"`
+	Deployment string `json:"deployment"`
+	RunningImage
+	Behind bool `json:"behind"`
+}
+
+// TagInfo is a tag of a repository and the containers running it.
+type TagInfo struct {
+	Tag         string     `json:"tag"`
+	Digest      string     `json:"digest,omitempty"`
+	Deployments []Deployed `json:"deployments"`
+}
+
+// DeployedImages returns the containers of deployments that run an image of
+// host/repository.
+func DeployedImages(deployments []appsv1.Deployment, host, repository string) []Deployed {
+	deployed := []Deployed{}
+	for _, deployment := range deployments {
+		for _, running := range RunningImages(deployment.Spec.Template) {
+			imageHost, imageRepository, _, _ := ParseImage(running.Image)
+			if imageHost == host && imageRepository == repository {
+				deployed = append(deployed, Deployed{Namespace: deployment.Namespace, Deployment: deployment.Name, RunningImage: running})
+			}
+		}
+	}
+	return deployed
+}
+
+// MatchTags fills in which of deployed run each tag, by tag name or by
+// digest when the tags have theirs, and marks the ones behind newest.
+// Containers pinned to a digest only are given the tag with that digest.
+func MatchTags(tags []TagInfo, deployed []Deployed, newest string) {
+	newestVersion, newestOK := semver.Parse(newest)
+	for i := range deployed {
+		for _, tag := range tags {
+			if deployed[i].Tag == "" && tag.Digest != "" && tag.Digest == deployed[i].Digest {
+				deployed[i].Tag = tag.Tag
+			}
+		}
+		if running, ok := semver.Parse(deployed[i].Tag); ok && newestOK {
+			deployed[i].Behind = semver.Compare(running, newestVersion) < 0
+		}
+	}
+
+	for i := range tags {
+		tags[i].Deployments = []Deployed{}
+		for _, d := range deployed {
+			if d.Tag == tags[i].Tag || (tags[i].Digest != "" && d.Digest == tags[i].Digest) {
+				tags[i].Deployments = append(tags[i].Deployments, d)
+			}
+		}
+	}
+}
+
+// NewestTag returns the highest release (non-prerelease) semantic version
+// among tags, or "" when none is one.
+func NewestTag(tags []string) string {
+	newest := ""
+	var newestVersion semver.Version
+	for _, tag := range tags {
+		v, ok := semver.Parse(tag)
+		if !ok || v.Prerelease() != "" {
+			continue
+		}
+		if newest == "" || semver.Compare(v, newestVersion) > 0 {
+			newest, newestVersion = tag, v
+		}
+	}
+	return newest
+}
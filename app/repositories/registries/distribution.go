@@ -0,0 +1,256 @@
+package registries
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chechetech/app/azure-go/config"
+)
+
+// manifestTypes are the manifests a tag can point at; asking for all of
+// them makes the registry answer with the digest the tag really has rather
+// than one of a converted manifest.
+var manifestTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// ErrRepositoryNotFound is returned for repositories or tags the registry
+// doesn't know.
+var ErrRepositoryNotFound = errors.New("repository not found")
+
+// ErrInvalidReference is returned for repository names and tags outside the
+// Distribution grammar, which could otherwise reach other endpoints of the
+// registry.
+var ErrInvalidReference = errors.New("invalid reference")
+
+var (
+	repositoryPattern = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	tagPattern        = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+)
+
+func validateRepository(repository string) error {
+	if !repositoryPattern.MatchString(repository) {
+		return fmt.Errorf("repository %q: %w", repository, ErrInvalidReference)
+	}
+	return nil
+}
+
+// Client reads repositories, tags and digests through the OCI Distribution
+// API. It answers bearer token challenges, which is how ACR, GHCR, Harbor
+// and Docker Hub authenticate, and falls back to basic auth. A Client is not
+// safe for concurrent use.
+type Client struct {
+	registry config.Registry
+	password string
+	http     *http.Client
+	// authorization is the last header that was accepted; it is sent up
+	// front so a run of requests only authenticates once.
+	authorization string
+}
+
+func NewClient(registry config.Registry) *Client {
+	return &Client{
+		registry: registry,
+		password: os.Getenv(registry.PasswordEnv),
+		http:     &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Catalog lists up to n repositories after last, in the registry's order.
+// next is the last argument for the following page, or "" at the end.
+func (c *Client) Catalog(ctx context.Context, n int, last string) (repositories []string, next string, err error) {
+	query := url.Values{}
+	if n > 0 {
+		query.Set("n", strconv.Itoa(n))
+	}
+	if last != "" {
+		query.Set("last", last)
+	}
+
+	var body struct {
+		Repositories []string `json:"repositories"`
+	}
+	response, err := c.get(ctx, http.MethodGet, "/v2/_catalog?"+query.Encode(), nil, &body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if strings.Contains(response.Header.Get("Link"), `rel="next"`) && len(body.Repositories) > 0 {
+		next = body.Repositories[len(body.Repositories)-1]
+	}
+	return body.Repositories, next, nil
+}
+
+// Tags lists the tags of a repository.
+func (c *Client) Tags(ctx context.Context, repository string) ([]string, error) {
+	if err := validateRepository(repository); err != nil {
+		return nil, err
+	}
+
+	var body struct {
+		Tags []string `json:"tags"`
+	}
+	if _, err := c.get(ctx, http.MethodGet, "/v2/"+repository+"/tags/list", nil, &body); err != nil {
+		return nil, err
+	}
+	return body.Tags, nil
+}
+
+// Digest returns the digest a tag points at.
+func (c *Client) Digest(ctx context.Context, repository, tag string) (string, error) {
+	if err := validateRepository(repository); err != nil {
+		return "", err
+	}
+	if !tagPattern.MatchString(tag) {
+		return "", fmt.Errorf("tag %q: %w", tag, ErrInvalidReference)
+	}
+
+	header := http.Header{"Accept": {strings.Join(manifestTypes, ", ")}}
+	response, err := c.get(ctx, http.MethodHead, "/v2/"+repository+"/manifests/"+url.PathEscape(tag), header, nil)
+	if err != nil {
+		return "", err
+	}
+	return response.Header.Get("Docker-Content-Digest"), nil
+}
+
+// get sends a request, answering an authentication challenge once, and
+// decodes the JSON body into out when it is not nil.
+func (c *Client) get(ctx context.Context, method, path string, header http.Header, out interface{}) (*http.Response, error) {
+	response, err := c.do(ctx, method, path, header, c.authorization)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode == http.StatusUnauthorized {
+		challenge := response.Header.Get("WWW-Authenticate")
+		response.Body.Close()
+
+		if c.authorization, err = c.authorize(ctx, challenge); err != nil {
+			return nil, err
+		}
+		if response, err = c.do(ctx, method, path, header, c.authorization); err != nil {
+			return nil, err
+		}
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusNotFound:
+		return nil, fmt.Errorf("%s%s: %w", c.registry.Host, path, ErrRepositoryNotFound)
+	case response.StatusCode >= 300:
+		return nil, fmt.Errorf("registry %s answered %s", c.registry.Name, response.Status)
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(response.Body).Decode(out); err != nil {
+			return nil, fmt.Errorf("failed to decode registry response: %w", err)
+		}
+	}
+	return response, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, header http.Header, authorization string) (*http.Response, error) {
+	request, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(c.registry.BaseURL(), "/")+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+
+	response, err := c.http.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach registry %s: %w", c.registry.Name, err)
+	}
+	return response, nil
+}
+
+// authorize answers a WWW-Authenticate challenge with the Authorization
+// header to retry with. Bearer challenges are exchanged for a token at the
+// realm they name, using the configured credentials if there are any.
+func (c *Client) authorize(ctx context.Context, challenge string) (string, error) {
+	scheme, params := parseChallenge(challenge)
+	if !strings.EqualFold(scheme, "bearer") {
+		if c.registry.Username == "" {
+			return "", fmt.Errorf("registry %s needs credentials", c.registry.Name)
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.registry.Username+":"+c.password)), nil
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("registry %s sent an invalid challenge %q", c.registry.Name, challenge)
+	}
+	query := realm.Query()
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+	realm.RawQuery = query.Encode()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.registry.Username != "" {
+		request.SetBasicAuth(c.registry.Username, c.password)
+	}
+
+	response, err := c.http.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("failed to get registry token: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		io.Copy(io.Discard, response.Body)
+		return "", fmt.Errorf("registry %s refused a token: %s", c.registry.Name, response.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&token); err != nil {
+		return "", fmt.Errorf("failed to decode registry token: %w", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	return "Bearer " + token.Token, nil
+}
+
+// parseChallenge splits `Bearer realm="...",service="..."` into the scheme
+// and its parameters.
+func parseChallenge(challenge string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	params := map[string]string{}
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, " ,"), "=")
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+	return scheme, params
+}
@@ -0,0 +1,77 @@
+package registries
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/chechetech/app/azure-go/config"
+)
+
+// ImageTagsAnnotation is set on the pod template and maps each container
+// name to the tag and digest it was deployed from, so a digest-pinned image
+// can still be shown by its human tag.
+const ImageTagsAnnotation = "dashboard-api/image-tags"
+
+// ImageTag is one entry of ImageTagsAnnotation.
+type ImageTag struct {
+	Tag    string `json:"tag,omitempty"`
+	Digest string `json:"digest,omitempty"`
+}
+
+var digestPattern = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]+$`)
+
+// ImagePath builds the image reference written into the pod template.
+func ImagePath(host, repository, tag, digest, mode string) (string, error) {
+	name := host + "/" + repository
+	if mode == config.ImageRefTag {
+		return fmt.Sprintf("%s:%s", name, tag), nil
+	}
+
+	if !digestPattern.MatchString(digest) {
+		return "", fmt.Errorf("image reference mode %q needs a digest, got %q", mode, digest)
+	}
+	if mode == config.ImageRefTagDigest && tag != "" {
+		return fmt.Sprintf("%s:%s@%s", name, tag, digest), nil
+	}
+	return fmt.Sprintf("%s@%s", name, digest), nil
+}
+
+// ImageTags reads ImageTagsAnnotation; a malformed value reads as empty.
+func ImageTags(annotations map[string]string) map[string]ImageTag {
+	tags := map[string]ImageTag{}
+	if value, ok := annotations[ImageTagsAnnotation]; ok {
+		json.Unmarshal([]byte(value), &tags)
+	}
+	return tags
+}
+
+// splitImage splits an image reference such as
+// "anansi.azurecr.io/siyaha/temariko/prod/web:4@sha256:..." into its name,
+// tag and digest. A colon only starts the tag when it comes after the last
+// slash, so registry ports are left in the name.
+func splitImage(image string) (name, tag, digest string) {
+	name = image
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, digest = name[:i], name[i+1:]
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, tag = name[:i], name[i+1:]
+	}
+	return name, tag, digest
+}
+
+// ParseImage splits an image reference into the registry host, repository,
+// tag and digest. The first path component is only the host when it looks
+// like one; otherwise the image is on Docker Hub.
+func ParseImage(image string) (host, repository, tag, digest string) {
+	name, tag, digest := splitImage(image)
+	if i := strings.Index(name, "/"); i >= 0 && (strings.ContainsAny(name[:i], ".:") || name[:i] == "localhost") {
+		return name[:i], name[i+1:], tag, digest
+	}
+	if !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	return "docker.io", name, tag, digest
+}
@@ -0,0 +1,84 @@
+package registries
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/chechetech/app/azure-go/config"
+	"github.com/chechetech/app/azure-go/repositories/semver"
+)
+
+// CheckTagPolicy returns the reason an event must not be deployed, or nil if
+// policy allows it. currentTag is the tag the container runs now and is only
+// consulted for OnlyNewer.
+func CheckTagPolicy(policy config.TagPolicy, action, tag, currentTag string) error {
+	actions := policy.Actions
+	if len(actions) == 0 {
+		actions = []string{"push"}
+	}
+	if !containsString(actions, action) {
+		return fmt.Errorf("action %q is ignored", action)
+	}
+
+	if tag == "" {
+		return errors.New("event has no tag")
+	}
+
+	for _, pattern := range policy.Deny {
+		if regexp.MustCompile(pattern).MatchString(tag) {
+			return fmt.Errorf("tag %q matches deny pattern %q", tag, pattern)
+		}
+	}
+
+	if len(policy.Allow) > 0 {
+		allowed := false
+		for _, pattern := range policy.Allow {
+			if regexp.MustCompile(pattern).MatchString(tag) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("tag %q does not match any allow pattern", tag)
+		}
+	}
+
+	if policy.Semver == "" && !policy.OnlyNewer {
+		return nil
+	}
+
+	v, ok := semver.Parse(tag)
+	if !ok {
+		return fmt.Errorf("tag %q is not a semantic version", tag)
+	}
+
+	if policy.Semver != "" {
+		r, err := semver.ParseRange(policy.Semver)
+		if err != nil {
+			return err
+		}
+		if !r.Contains(v) {
+			return fmt.Errorf("tag %q is outside semver range %q", tag, policy.Semver)
+		}
+	}
+
+	if policy.OnlyNewer {
+		// Nothing to compare against when the running tag isn't a version,
+		// e.g. a deployment still on "latest" being moved to a release.
+		if current, ok := semver.Parse(currentTag); ok && semver.Compare(v, current) <= 0 {
+			return fmt.Errorf("tag %q is not newer than running tag %q", tag, currentTag)
+		}
+	}
+
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
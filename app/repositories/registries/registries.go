@@ -2,30 +2,192 @@ package registries
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
 )
 
-func UpdateDeploymentImage(clientset *kubernetes.Clientset, namespace, deploymentName, imagePath string) error {
+// FieldManager is recorded as the owner of every field we change so that
+// kubectl and other controllers can see who last touched the image.
+const FieldManager = "dashboard-api"
+
+// RevisionAnnotation is where the deployment controller keeps the revision
+// of a Deployment and of each of its ReplicaSets.
+const RevisionAnnotation = "deployment.kubernetes.io/revision"
+
+// ImageUpdate describes a new image for one container. An empty Container
+// means the first container of the pod template; Tag and Digest are kept
+// in ImageTagsAnnotation.
+type ImageUpdate struct {
+	Container string
+	Image     string
+	Tag       string
+	Digest    string
+}
+
+// RunningImage is the image a container runs, with the tag it was deployed
+// from when the image itself is pinned to a digest.
+type RunningImage struct {
+	Container string `json:"container"`
+	Image     string `json:"image"`
+	Tag       string `json:"tag,omitempty"`
+	Digest    string `json:"digest,omitempty"`
+}
+
+// UpdateResult tells what UpdateDeploymentImage changed. PreviousRevision
+// is the deployment revision that was live before the change and is what a
+// rollback should return to.
+type UpdateResult struct {
+	Changed          bool
+	Container        string
+	PreviousImage    string
+	PreviousRevision string
+	Generation       int64
+}
+
+func UpdateDeploymentImage(clientset *kubernetes.Clientset, namespace, deploymentName string, update ImageUpdate) (UpdateResult, error) {
+	var result UpdateResult
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		deployment, err := clientset.AppsV1().Deployments(namespace).Get(context.TODO(), deploymentName, v1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get deployment: %w", err)
+		}
+
+		container, err := findContainer(deployment, update.Container)
+		if err != nil {
+			return err
+		}
+
+		result = UpdateResult{
+			Container:        container.Name,
+			PreviousImage:    container.Image,
+			PreviousRevision: deployment.Annotations[RevisionAnnotation],
+			Generation:       deployment.Generation,
+		}
+
+		tags := ImageTags(deployment.Spec.Template.Annotations)
+		tag := ImageTag{Tag: update.Tag, Digest: update.Digest}
+		if container.Image == update.Image && tags[container.Name] == tag {
+			return nil
+		}
+
+		if tag == (ImageTag{}) {
+			delete(tags, container.Name)
+		} else {
+			tags[container.Name] = tag
+		}
+
+		// The resourceVersion turns the patch into a precondition: if the
+		// deployment changed since the Get, the API server answers with a
+		// conflict and RetryOnConflict re-reads it before trying again.
+		patch, err := imagePatch(deployment.ResourceVersion, container.Name, update.Image, tags)
+		if err != nil {
+			return err
+		}
+
+		patched, err := clientset.AppsV1().Deployments(namespace).Patch(context.TODO(), deploymentName, types.StrategicMergePatchType, patch, v1.PatchOptions{FieldManager: FieldManager})
+		if err != nil {
+			return fmt.Errorf("failed to patch deployment: %w", err)
+		}
+
+		result.Changed = true
+		result.Generation = patched.Generation
+		return nil
+	})
+
+	return result, err
+}
+
+// GetDeploymentImage returns the image containerName currently runs.
+func GetDeploymentImage(clientset *kubernetes.Clientset, namespace, deploymentName, containerName string) (RunningImage, error) {
 	deployment, err := clientset.AppsV1().Deployments(namespace).Get(context.TODO(), deploymentName, v1.GetOptions{})
 	if err != nil {
-		return fmt.Errorf("failed to get deployment: %v", err)
+		return RunningImage{}, fmt.Errorf("failed to get deployment: %w", err)
+	}
+
+	container, err := findContainer(deployment, containerName)
+	if err != nil {
+		return RunningImage{}, err
 	}
 
-	originalImage := deployment.Spec.Template.Spec.Containers[0].Image
-	deployment.Spec.Template.Spec.Containers[0].Image = imagePath
+	return runningImage(container.Name, container.Image, ImageTags(deployment.Spec.Template.Annotations)), nil
+}
+
+// RunningImages lists the image of every container of a pod template.
+func RunningImages(template corev1.PodTemplateSpec) []RunningImage {
+	tags := ImageTags(template.Annotations)
+	images := make([]RunningImage, 0, len(template.Spec.Containers))
+	for _, container := range template.Spec.Containers {
+		images = append(images, runningImage(container.Name, container.Image, tags))
+	}
+	return images
+}
 
-	_, updateErr := clientset.AppsV1().Deployments(namespace).Update(context.TODO(), deployment, v1.UpdateOptions{})
-	if updateErr != nil {
-		deployment.Spec.Template.Spec.Containers[0].Image = originalImage
-		_, revertErr := clientset.AppsV1().Deployments(namespace).Update(context.TODO(), deployment, v1.UpdateOptions{})
-		if revertErr != nil {
-			return fmt.Errorf("update failed and revert also failed: %v", revertErr)
+// runningImage prefers the recorded tag over the one in the image, which is
+// missing for digest-only references.
+func runningImage(containerName, image string, tags map[string]ImageTag) RunningImage {
+	_, tag, digest := splitImage(image)
+	running := RunningImage{Container: containerName, Image: image, Tag: tag, Digest: digest}
+	if recorded, ok := tags[containerName]; ok {
+		if recorded.Tag != "" {
+			running.Tag = recorded.Tag
 		}
-		return fmt.Errorf("update failed but reverted to original image: %v", updateErr)
+		if running.Digest == "" {
+			running.Digest = recorded.Digest
+		}
+	}
+	return running
+}
+
+func findContainer(deployment *appsv1.Deployment, containerName string) (*corev1.Container, error) {
+	containers := deployment.Spec.Template.Spec.Containers
+	if len(containers) == 0 {
+		return nil, fmt.Errorf("deployment %s has no containers", deployment.Name)
+	}
+
+	if containerName == "" {
+		return &containers[0], nil
+	}
+
+	for i := range containers {
+		if containers[i].Name == containerName {
+			return &containers[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("deployment %s has no container %q", deployment.Name, containerName)
+}
+
+// imagePatch builds a strategic-merge patch that only touches the image of
+// the named container and the tag annotation; containers are merged by name
+// so the rest of the pod template is left alone.
+func imagePatch(resourceVersion, containerName, imagePath string, tags map[string]ImageTag) ([]byte, error) {
+	annotation, err := json.Marshal(tags)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	return json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": resourceVersion,
+		},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{ImageTagsAnnotation: string(annotation)},
+				},
+				"spec": map[string]interface{}{
+					"containers": []map[string]interface{}{
+						{"name": containerName, "image": imagePath},
+					},
+				},
+			},
+		},
+	})
 }
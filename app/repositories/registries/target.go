@@ -0,0 +1,37 @@
+package registries
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/chechetech/app/azure-go/config"
+)
+
+// Target is the container a registry event deploys to. An empty Container
+// means the first container of the pod template.
+type Target struct {
+	Namespace  string `json:"namespace"`
+	Deployment string `json:"deployment"`
+	Container  string `json:"container,omitempty"`
+}
+
+// ResolveTarget finds where a push to repository should be deployed. A
+// configured mapping wins; otherwise the repository name is read as
+// <company>/<namespace>/<app...>, except for cheche whose namespace is the
+// company itself.
+func ResolveTarget(cfg *config.Config, repository string) (Target, *config.Mapping, error) {
+	if mapping := cfg.MappingFor(repository); mapping != nil {
+		return Target{Namespace: mapping.Namespace, Deployment: mapping.Deployment, Container: mapping.Container}, mapping, nil
+	}
+
+	parts := strings.SplitN(repository, "/", 3)
+	if len(parts) < 3 {
+		return Target{}, nil, fmt.Errorf("repository %q has no mapping and does not follow <company>/<namespace>/<app>", repository)
+	}
+
+	company := parts[0]
+	if company == "cheche" {
+		return Target{Namespace: company, Deployment: strings.ReplaceAll(parts[1]+"/"+parts[2], "/", "-")}, nil, nil
+	}
+	return Target{Namespace: parts[1], Deployment: strings.ReplaceAll(parts[2], "/", "-")}, nil, nil
+}
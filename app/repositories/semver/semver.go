@@ -0,0 +1,259 @@
+// Package semver parses the semantic versions of image tags and the npm
+// style ranges tag policies select them with.
+package semver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Version is a parsed semantic version. Tags like "v1.2" are accepted and
+// treated as "1.2.0"; build metadata after "+" is ignored.
+type Version struct {
+	major, minor, patch int
+	pre                 string
+}
+
+// Parse parses a version, reporting whether s is one.
+func Parse(s string) (Version, bool) {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "v"), "V")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+
+	var v Version
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		v.pre = s[i+1:]
+		s = s[:i]
+		if v.pre == "" {
+			return Version{}, false
+		}
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return Version{}, false
+	}
+
+	nums := [3]int{}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return Version{}, false
+		}
+		nums[i] = n
+	}
+	v.major, v.minor, v.patch = nums[0], nums[1], nums[2]
+
+	return v, true
+}
+
+// Prerelease is what follows the "-" of a pre-release, or "".
+func (v Version) Prerelease() string {
+	return v.pre
+}
+
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.major, v.minor, v.patch)
+	if v.pre != "" {
+		s += "-" + v.pre
+	}
+	return s
+}
+
+// Compare returns -1, 0 or 1 as a sorts before, with or after b.
+func Compare(a, b Version) int {
+	for _, d := range [3]int{a.major - b.major, a.minor - b.minor, a.patch - b.patch} {
+		if d != 0 {
+			return sign(d)
+		}
+	}
+
+	// A pre-release sorts before the release it precedes.
+	switch {
+	case a.pre == b.pre:
+		return 0
+	case a.pre == "":
+		return 1
+	case b.pre == "":
+		return -1
+	}
+
+	aIDs, bIDs := strings.Split(a.pre, "."), strings.Split(b.pre, ".")
+	for i := 0; i < len(aIDs) && i < len(bIDs); i++ {
+		aNum, aErr := strconv.Atoi(aIDs[i])
+		bNum, bErr := strconv.Atoi(bIDs[i])
+		switch {
+		case aErr == nil && bErr == nil:
+			if aNum != bNum {
+				return sign(aNum - bNum)
+			}
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+		default:
+			if c := strings.Compare(aIDs[i], bIDs[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return sign(len(aIDs) - len(bIDs))
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+type comparator struct {
+	op string
+	v  Version
+}
+
+func (c comparator) matches(v Version) bool {
+	cmp := Compare(v, c.v)
+	switch c.op {
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case "!=":
+		return cmp != 0
+	}
+	return cmp == 0
+}
+
+// Range is a union of comparator sets: "1.x || >=2.1 <3".
+type Range [][]comparator
+
+// ParseRange parses a range as npm writes them, with partial versions,
+// wildcards and the ~ and ^ shorthands. An empty alternative, as in "^1 ||",
+// is an error rather than matching every version; "*" does that.
+func ParseRange(s string) (Range, error) {
+	var r Range
+	for _, group := range strings.Split(s, "||") {
+		fields := strings.Fields(strings.ReplaceAll(group, ",", " "))
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("invalid semver range %q: empty alternative", s)
+		}
+
+		var set []comparator
+		for _, field := range fields {
+			comparators, err := parseComparator(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid semver range %q: %w", s, err)
+			}
+			set = append(set, comparators...)
+		}
+		r = append(r, set)
+	}
+	return r, nil
+}
+
+func parseComparator(s string) ([]comparator, error) {
+	op := ""
+	for _, prefix := range []string{">=", "<=", "!=", ">", "<", "=", "~", "^"} {
+		if strings.HasPrefix(s, prefix) {
+			op, s = prefix, s[len(prefix):]
+			break
+		}
+	}
+
+	if s == "*" || s == "x" || s == "X" {
+		return nil, nil
+	}
+
+	// Wildcards and partial versions ("1.x", "1.2") describe a range.
+	core := strings.TrimPrefix(s, "v")
+	if i := strings.IndexAny(core, "-+"); i >= 0 {
+		core = core[:i]
+	}
+	parts := strings.Split(core, ".")
+	given := 0
+	for given < len(parts) && parts[given] != "x" && parts[given] != "X" && parts[given] != "*" {
+		given++
+	}
+	if given < len(parts) {
+		if given == 0 {
+			return nil, nil
+		}
+		s = strings.Join(parts[:given], ".")
+	}
+
+	v, ok := Parse(s)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a version", s)
+	}
+
+	// The version after a partial one: 1.3.0 after 1.2, 2.0.0 after 1.
+	next := Version{major: v.major, minor: v.minor + 1}
+	if given == 1 {
+		next = Version{major: v.major + 1}
+	}
+
+	switch {
+	case given < 3 && op == ">":
+		// Above 1.2 is from 1.3.0 on, not from 1.2.1.
+		return []comparator{{">=", next}}, nil
+	case given < 3 && op == "<=":
+		// Up to 1.2 takes in all of 1.2.x but no pre-release of 1.3.0.
+		next.pre = "0"
+		return []comparator{{"<", next}}, nil
+	case op == "^":
+		// The first part that isn't zero may not change: ^1.2.3 is below
+		// 2.0.0, ^0.2.3 below 0.3.0 and ^0.0.3 below 0.0.4.
+		upper := Version{major: v.major + 1}
+		switch {
+		case v.major == 0 && v.minor == 0 && given == 3:
+			upper = Version{patch: v.patch + 1}
+		case v.major == 0 && given != 1:
+			upper = Version{minor: v.minor + 1}
+		}
+		return []comparator{{">=", v}, {"<", upper}}, nil
+	case op == "~" || ((op == "" || op == "=") && given < 3):
+		return []comparator{{">=", v}, {"<", next}}, nil
+	}
+
+	return []comparator{{op, v}}, nil
+}
+
+// Contains follows the npm convention that a pre-release only satisfies a
+// range if a comparator in the same set names a pre-release of the same
+// major.minor.patch, so "1.4.0-ci.12" doesn't sneak past ">=1.0.0".
+func (r Range) Contains(v Version) bool {
+	for _, set := range r {
+		if setContains(set, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func setContains(set []comparator, v Version) bool {
+	for _, c := range set {
+		if !c.matches(v) {
+			return false
+		}
+	}
+
+	if v.pre == "" {
+		return true
+	}
+	for _, c := range set {
+		if c.v.pre != "" && c.v.major == v.major && c.v.minor == v.minor && c.v.patch == v.patch {
+			return true
+		}
+	}
+	return false
+}
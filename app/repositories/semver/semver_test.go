@@ -0,0 +1,105 @@
+package semver
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"1.2.3", "1.2.3", true},
+		{"v1.2", "1.2.0", true},
+		{"V2", "2.0.0", true},
+		{"1.2.3-rc.1+build.5", "1.2.3-rc.1", true},
+		{"1.2.3-", "", false},
+		{"1.2.3.4", "", false},
+		{"latest", "", false},
+		{"1.-2", "", false},
+	}
+	for _, test := range tests {
+		v, ok := Parse(test.in)
+		if ok != test.ok || (ok && v.String() != test.want) {
+			t.Errorf("Parse(%q) = %v, %v; want %v, %v", test.in, v, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.2.3", "1.2.3", 0},
+		{"1.2.3", "1.2.4", -1},
+		{"1.10.0", "1.9.0", 1},
+		{"1.0.0-rc.1", "1.0.0", -1},
+		{"1.0.0-rc.2", "1.0.0-rc.10", -1},
+		{"1.0.0-1", "1.0.0-alpha", -1},
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{"1.0.0-beta", "1.0.0-alpha", 1},
+	}
+	for _, test := range tests {
+		a, _ := Parse(test.a)
+		b, _ := Parse(test.b)
+		if got := Compare(a, b); got != test.want {
+			t.Errorf("Compare(%s, %s) = %d; want %d", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestRangeContains(t *testing.T) {
+	tests := []struct {
+		r       string
+		in, out []string
+	}{
+		{"^1.2.3", []string{"1.2.3", "1.9.0"}, []string{"1.2.2", "2.0.0", "2.0.0-rc.1"}},
+		{"^0.2.3", []string{"0.2.3", "0.2.9"}, []string{"0.3.0", "0.2.2"}},
+		{"^0.0.3", []string{"0.0.3"}, []string{"0.0.4", "0.1.0"}},
+		{"^0.0", []string{"0.0.0", "0.0.9"}, []string{"0.1.0"}},
+		{"^1", []string{"1.0.0", "1.9.9"}, []string{"2.0.0", "0.9.0"}},
+		{"~1.2.3", []string{"1.2.3", "1.2.9"}, []string{"1.3.0", "1.2.2"}},
+		{"~1", []string{"1.0.0", "1.9.0"}, []string{"2.0.0"}},
+		{"1.2", []string{"1.2.0", "1.2.9"}, []string{"1.3.0", "1.1.9"}},
+		{"1.x", []string{"1.0.0", "1.9.0"}, []string{"2.0.0"}},
+		{"*", []string{"0.0.1", "9.9.9"}, []string{"1.0.0-rc.1"}},
+		{">1.2", []string{"1.3.0", "2.0.0"}, []string{"1.2.0", "1.2.9"}},
+		{">1", []string{"2.0.0"}, []string{"1.9.9"}},
+		{">1.2.3", []string{"1.2.4"}, []string{"1.2.3"}},
+		{">=1.2", []string{"1.2.0"}, []string{"1.1.9"}},
+		{"<1.2", []string{"1.1.9"}, []string{"1.2.0"}},
+		{"<=1.2", []string{"1.2.0", "1.2.9"}, []string{"1.3.0", "1.3.0-0", "1.3.0-rc.1"}},
+		{"<=1", []string{"1.9.9"}, []string{"2.0.0"}},
+		{"<=1.2.3", []string{"1.2.3"}, []string{"1.2.4"}},
+		{"!=1.2.3", []string{"1.2.4"}, []string{"1.2.3"}},
+		{">=1.0.0 <2.0.0", []string{"1.5.0"}, []string{"2.0.0", "1.4.0-ci.12"}},
+		{">=1.4.0-rc.1 <2", []string{"1.4.0-rc.2", "1.4.0"}, []string{"1.5.0-rc.1"}},
+		{"1.x || >=3.1 <4", []string{"1.2.0", "3.1.0"}, []string{"2.0.0", "3.0.9", "4.0.0"}},
+		{">=1.2, <1.3", []string{"1.2.5"}, []string{"1.3.0"}},
+	}
+	for _, test := range tests {
+		r, err := ParseRange(test.r)
+		if err != nil {
+			t.Errorf("ParseRange(%q): %v", test.r, err)
+			continue
+		}
+		for _, s := range test.in {
+			if v, _ := Parse(s); !r.Contains(v) {
+				t.Errorf("%q should contain %s", test.r, s)
+			}
+		}
+		for _, s := range test.out {
+			if v, _ := Parse(s); r.Contains(v) {
+				t.Errorf("%q should not contain %s", test.r, s)
+			}
+		}
+	}
+}
+
+func TestParseRangeErrors(t *testing.T) {
+	for _, s := range []string{"", "^1 ||", "|| ^1", "^1 || || ^2", ">=abc", "^1.2.3.4"} {
+		if _, err := ParseRange(s); err == nil {
+			t.Errorf("ParseRange(%q) should fail", s)
+		}
+	}
+}
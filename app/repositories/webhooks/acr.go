@@ -0,0 +1,70 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+)
+
+type WebhookTarget struct {
+	MediaType  string
+	Size       int32
+	Digest     string
+	Length     int32
+	Repository string
+	Tag        string
+}
+
+type WebhookRequest struct {
+	ID        string
+	Host      string
+	Method    string
+	UserAgent string
+}
+
+// Webhook is the Azure Container Registry event schema.
+type Webhook struct {
+	ID        string
+	Timestamp string
+	Action    string
+	Target    WebhookTarget
+	Request   WebhookRequest
+}
+
+type acrParser struct{}
+
+func (acrParser) Name() string { return "acr" }
+
+func (acrParser) Detect(header http.Header, body []byte) bool {
+	var probe struct {
+		Target *json.RawMessage `json:"target"`
+	}
+	return json.Unmarshal(body, &probe) == nil && probe.Target != nil
+}
+
+func (acrParser) Parse(header http.Header, body []byte) ([]Event, error) {
+	var webhook Webhook
+	if err := json.Unmarshal(body, &webhook); err != nil {
+		return nil, err
+	}
+	if webhook.Target.Repository == "" {
+		return nil, errors.New("target.repository is required")
+	}
+
+	id := webhook.ID
+	if id == "" {
+		id = contentID(webhook.Timestamp, webhook.Action, webhook.Target.Repository, webhook.Target.Tag, webhook.Target.Digest)
+	}
+
+	return []Event{{
+		ID:         id,
+		ReceivedAt: time.Now(),
+		Source:     "acr",
+		Action:     webhook.Action,
+		Host:       webhook.Request.Host,
+		Repository: webhook.Target.Repository,
+		Tag:        webhook.Target.Tag,
+		Digest:     webhook.Target.Digest,
+	}}, nil
+}
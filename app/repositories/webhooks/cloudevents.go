@@ -0,0 +1,101 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// cloudEvent is a CloudEvents 1.0 envelope in structured mode. In binary
+// mode the attributes come as ce-* headers and the body is the data.
+type cloudEvent struct {
+	SpecVersion string          `json:"specversion"`
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	Source      string          `json:"source"`
+	Data        json.RawMessage `json:"data"`
+}
+
+// imagePushData is what we expect in the data of an image.push event:
+// either the parts of the image or a full "host/repo:tag@digest" reference.
+type imagePushData struct {
+	Image      string `json:"image"`
+	Host       string `json:"host"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+	Digest     string `json:"digest"`
+}
+
+type cloudEventsParser struct{}
+
+func (cloudEventsParser) Name() string { return "cloudevents" }
+
+func (cloudEventsParser) Detect(header http.Header, body []byte) bool {
+	if header.Get("Ce-Specversion") != "" {
+		return true
+	}
+	var event cloudEvent
+	return json.Unmarshal(body, &event) == nil && event.SpecVersion != ""
+}
+
+func (cloudEventsParser) Parse(header http.Header, body []byte) ([]Event, error) {
+	var event cloudEvent
+	if header.Get("Ce-Specversion") != "" {
+		event = cloudEvent{
+			SpecVersion: header.Get("Ce-Specversion"),
+			ID:          header.Get("Ce-Id"),
+			Type:        header.Get("Ce-Type"),
+			Source:      header.Get("Ce-Source"),
+			Data:        body,
+		}
+	} else if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+
+	if event.ID == "" || event.Type == "" {
+		return nil, errors.New("id and type are required")
+	}
+
+	// Anything but a push, such as "com.example.image.delete", is passed
+	// on under its last segment so tag policies can ignore it.
+	action := event.Type[strings.LastIndex(event.Type, ".")+1:]
+	if strings.HasSuffix(event.Type, "image.push") {
+		action = "push"
+	}
+
+	var data imagePushData
+	if err := json.Unmarshal(event.Data, &data); err != nil {
+		return nil, err
+	}
+	if data.Image != "" {
+		host, repository, tag := splitImageURL(data.Image)
+		if i := strings.Index(data.Image, "@"); i >= 0 && data.Digest == "" {
+			data.Digest = data.Image[i+1:]
+		}
+		if data.Host == "" {
+			data.Host = host
+		}
+		if data.Repository == "" {
+			data.Repository = repository
+		}
+		if data.Tag == "" {
+			data.Tag = tag
+		}
+	}
+	if data.Repository == "" {
+		return nil, errors.New("data.repository or data.image is required")
+	}
+
+	return []Event{{
+		ID:         event.ID,
+		ReceivedAt: time.Now(),
+		Source:     "cloudevents",
+		Action:     action,
+		Host:       data.Host,
+		Repository: data.Repository,
+		Tag:        data.Tag,
+		Digest:     data.Digest,
+	}}, nil
+}
@@ -0,0 +1,51 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// dockerHubPayload is the part of a Docker Hub repository webhook we use.
+// Docker Hub only notifies about pushes and sends no digest.
+type dockerHubPayload struct {
+	PushData *struct {
+		PushedAt int64  `json:"pushed_at"`
+		Pusher   string `json:"pusher"`
+		Tag      string `json:"tag"`
+	} `json:"push_data"`
+	Repository struct {
+		RepoName string `json:"repo_name"`
+	} `json:"repository"`
+}
+
+type dockerHubParser struct{}
+
+func (dockerHubParser) Name() string { return "dockerhub" }
+
+func (dockerHubParser) Detect(header http.Header, body []byte) bool {
+	var payload dockerHubPayload
+	return json.Unmarshal(body, &payload) == nil && payload.PushData != nil
+}
+
+func (dockerHubParser) Parse(header http.Header, body []byte) ([]Event, error) {
+	var payload dockerHubPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	if payload.PushData == nil || payload.Repository.RepoName == "" {
+		return nil, errors.New("push_data and repository.repo_name are required")
+	}
+
+	return []Event{{
+		ID:         contentID("dockerhub", payload.Repository.RepoName, payload.PushData.Tag, fmt.Sprint(payload.PushData.PushedAt)),
+		ReceivedAt: time.Now(),
+		Source:     "dockerhub",
+		Action:     "push",
+		Host:       "docker.io",
+		Repository: payload.Repository.RepoName,
+		Tag:        payload.PushData.Tag,
+	}}, nil
+}
@@ -0,0 +1,99 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// githubPayload is the part of a GitHub "package" or "registry_package"
+// webhook we use for container packages on ghcr.io.
+type githubPayload struct {
+	Action  string         `json:"action"`
+	Package *githubPackage `json:"package"`
+	// registry_package events carry the same object under another key.
+	RegistryPackage *githubPackage `json:"registry_package"`
+}
+
+type githubPackage struct {
+	Name           string `json:"name"`
+	Namespace      string `json:"namespace"`
+	PackageType    string `json:"package_type"`
+	PackageVersion struct {
+		Version           string `json:"version"`
+		PackageURL        string `json:"package_url"`
+		ContainerMetadata struct {
+			Tag struct {
+				Name   string `json:"name"`
+				Digest string `json:"digest"`
+			} `json:"tag"`
+		} `json:"container_metadata"`
+	} `json:"package_version"`
+}
+
+type githubParser struct{}
+
+func (githubParser) Name() string { return "github" }
+
+func (githubParser) Detect(header http.Header, body []byte) bool {
+	event := header.Get("X-GitHub-Event")
+	return event == "package" || event == "registry_package"
+}
+
+func (githubParser) Parse(header http.Header, body []byte) ([]Event, error) {
+	var payload githubPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+
+	pkg := payload.Package
+	if pkg == nil {
+		pkg = payload.RegistryPackage
+	}
+	if pkg == nil {
+		return nil, errors.New("package is required")
+	}
+	if !strings.EqualFold(pkg.PackageType, "container") {
+		return nil, errors.New("only container packages can be deployed")
+	}
+
+	version := pkg.PackageVersion
+	host, repository, tag := splitImageURL(version.PackageURL)
+	if repository == "" {
+		host, repository = "ghcr.io", strings.ToLower(pkg.Namespace+"/"+pkg.Name)
+	}
+	if host == "" {
+		host = "ghcr.io"
+	}
+	if metadataTag := version.ContainerMetadata.Tag.Name; metadataTag != "" {
+		tag = metadataTag
+	}
+	digest := version.ContainerMetadata.Tag.Digest
+	if digest == "" && strings.HasPrefix(version.Version, "sha256:") {
+		digest = version.Version
+	}
+
+	// GitHub calls a push "published"; the tag policies speak of pushes.
+	action := payload.Action
+	if action == "published" || action == "updated" {
+		action = "push"
+	}
+
+	id := header.Get("X-GitHub-Delivery")
+	if id == "" {
+		id = contentID("github", repository, tag, digest)
+	}
+
+	return []Event{{
+		ID:         id,
+		ReceivedAt: time.Now(),
+		Source:     "github",
+		Action:     action,
+		Host:       host,
+		Repository: repository,
+		Tag:        tag,
+		Digest:     digest,
+	}}, nil
+}
@@ -0,0 +1,80 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// harborPayload is the part of a Harbor v2 webhook we use. One event can
+// list several pushed artifacts.
+type harborPayload struct {
+	Type      string `json:"type"`
+	OccurAt   int64  `json:"occur_at"`
+	Operator  string `json:"operator"`
+	EventData *struct {
+		Resources []struct {
+			Digest      string `json:"digest"`
+			Tag         string `json:"tag"`
+			ResourceURL string `json:"resource_url"`
+		} `json:"resources"`
+		Repository struct {
+			RepoFullName string `json:"repo_full_name"`
+		} `json:"repository"`
+	} `json:"event_data"`
+}
+
+var harborActions = map[string]string{
+	"PUSH_ARTIFACT":   "push",
+	"DELETE_ARTIFACT": "delete",
+	"PULL_ARTIFACT":   "pull",
+	"UPLOAD_CHART":    "chart_push",
+	"DELETE_CHART":    "chart_delete",
+}
+
+type harborParser struct{}
+
+func (harborParser) Name() string { return "harbor" }
+
+func (harborParser) Detect(header http.Header, body []byte) bool {
+	var payload harborPayload
+	return json.Unmarshal(body, &payload) == nil && payload.EventData != nil && payload.Type != ""
+}
+
+func (harborParser) Parse(header http.Header, body []byte) ([]Event, error) {
+	var payload harborPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	if payload.EventData == nil || payload.EventData.Repository.RepoFullName == "" {
+		return nil, errors.New("event_data.repository.repo_full_name is required")
+	}
+
+	action, ok := harborActions[payload.Type]
+	if !ok {
+		action = strings.ToLower(payload.Type)
+	}
+
+	var events []Event
+	for _, resource := range payload.EventData.Resources {
+		host, _, _ := splitImageURL(resource.ResourceURL)
+		events = append(events, Event{
+			ID:         contentID("harbor", payload.Type, fmt.Sprint(payload.OccurAt), payload.EventData.Repository.RepoFullName, resource.Tag, resource.Digest),
+			ReceivedAt: time.Now(),
+			Source:     "harbor",
+			Action:     action,
+			Host:       host,
+			Repository: payload.EventData.Repository.RepoFullName,
+			Tag:        resource.Tag,
+			Digest:     resource.Digest,
+		})
+	}
+	if len(events) == 0 {
+		return nil, errors.New("event_data.resources is empty")
+	}
+
+	return events, nil
+}
@@ -0,0 +1,75 @@
+package webhooks
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Parser normalises the push notifications of one registry into Events.
+// Parsers only fill in what the payload says; routing and status are left
+// to the caller.
+type Parser interface {
+	// Name is what the source query parameter selects the parser by.
+	Name() string
+	// Detect reports whether a payload looks like it came from this
+	// registry, for requests that don't name their source.
+	Detect(header http.Header, body []byte) bool
+	Parse(header http.Header, body []byte) ([]Event, error)
+}
+
+// Parsers are tried in order when detecting the source of a payload.
+var Parsers = []Parser{
+	cloudEventsParser{},
+	githubParser{},
+	harborParser{},
+	dockerHubParser{},
+	acrParser{},
+}
+
+var ErrUnknownSource = errors.New("unknown webhook source")
+
+// Parse normalises a webhook payload. source names a parser; when it is
+// empty the parser is detected from the payload.
+func Parse(source string, header http.Header, body []byte) ([]Event, error) {
+	for _, parser := range Parsers {
+		if source == parser.Name() || (source == "" && parser.Detect(header, body)) {
+			events, err := parser.Parse(header, body)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s payload: %w", parser.Name(), err)
+			}
+			return events, nil
+		}
+	}
+
+	if source != "" {
+		return nil, fmt.Errorf("%w %q", ErrUnknownSource, source)
+	}
+	return nil, ErrUnknownSource
+}
+
+// contentID derives an event ID from the payload for registries that don't
+// send one, so that redeliveries are still recognised as duplicates.
+func contentID(parts ...string) string {
+	sum := sha256.Sum256([]byte(strings.Join(parts, "|")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// splitImageURL splits "host/repo/name:tag" into its host, repository and
+// tag. The first component is only a host if it looks like one.
+func splitImageURL(url string) (host, repository, tag string) {
+	url = strings.TrimPrefix(strings.TrimPrefix(url, "https://"), "http://")
+	if i := strings.Index(url, "@"); i >= 0 {
+		url = url[:i]
+	}
+	if i := strings.LastIndex(url, ":"); i > strings.LastIndex(url, "/") {
+		url, tag = url[:i], url[i+1:]
+	}
+	if i := strings.Index(url, "/"); i >= 0 && strings.ContainsAny(url[:i], ".:") {
+		return url[:i], url[i+1:], tag
+	}
+	return "", url, tag
+}
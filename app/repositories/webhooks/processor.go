@@ -0,0 +1,95 @@
+package webhooks
+
+import (
+	"fmt"
+
+	"github.com/chechetech/app/azure-go/config"
+	"github.com/chechetech/app/azure-go/repositories/changes"
+	"github.com/chechetech/app/azure-go/repositories/registries"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Processor turns queued registry events into image changes.
+type Processor struct {
+	clientset *kubernetes.Clientset
+	cfg       *config.Config
+	changes   *changes.Manager
+}
+
+func NewProcessor(clientset *kubernetes.Clientset, cfg *config.Config, changeManager *changes.Manager) *Processor {
+	return &Processor{clientset: clientset, cfg: cfg, changes: changeManager}
+}
+
+// Process checks the tag policy and submits the image change. It is a
+// ProcessFunc for Queue.Run.
+func (p *Processor) Process(event Event) (Event, bool) {
+	mapping := p.cfg.MappingFor(event.Repository)
+	policy := p.cfg.TagPolicyFor(mapping)
+
+	var current registries.RunningImage
+	if policy.OnlyNewer {
+		var err error
+		current, err = registries.GetDeploymentImage(p.clientset, event.Namespace, event.Deployment, event.Container)
+		if err != nil {
+			event.Status, event.Reason = StatusFailed, err.Error()
+			return event, changes.Retryable(err)
+		}
+	}
+
+	if err := registries.CheckTagPolicy(policy, event.Action, event.Tag, current.Tag); err != nil {
+		event.Status, event.Reason = StatusRejected, err.Error()
+		return event, false
+	}
+
+	imagePath, err := registries.ImagePath(event.Host, event.Repository, event.Tag, event.Digest, p.cfg.ImageRefFor(mapping))
+	if err != nil {
+		event.Status, event.Reason = StatusRejected, err.Error()
+		return event, false
+	}
+	event.Image = imagePath
+
+	fmt.Println("Namespace: ", event.Namespace, "Deployment Name: ", event.Deployment, "Image Path: ", imagePath)
+
+	change, err := p.changes.Submit(changes.Change{
+		WebhookID:  event.ID,
+		Actor:      event.Actor,
+		Repository: event.Repository,
+		Namespace:  event.Namespace,
+		Deployment: event.Deployment,
+		Container:  event.Container,
+		Image:      imagePath,
+		Tag:        event.Tag,
+		Digest:     event.Digest,
+	})
+	event.ChangeID, event.HistoryID = change.ID, change.HistoryID
+	if err != nil {
+		// The manager already retried the patch and recorded and notified
+		// the failure, so the event isn't submitted again.
+		event.Status, event.Reason = StatusFailed, err.Error()
+		return event, false
+	}
+
+	event.Status, event.Reason = eventStatus(change)
+	return event, false
+}
+
+// eventStatus is the status of an event whose change has got as far as
+// change.
+func eventStatus(change changes.Change) (status, reason string) {
+	switch change.Status {
+	case changes.StatusPending, changes.StatusApproved:
+		return StatusHeld, change.Reason
+	case changes.StatusCanary:
+		return StatusCanary, change.Reason
+	case changes.StatusRejected:
+		if change.DecidedBy == "" {
+			return StatusRejected, "change rejected"
+		}
+		return StatusRejected, "change rejected by " + change.DecidedBy
+	case changes.StatusSuperseded:
+		return StatusSuperseded, change.Reason
+	case changes.StatusFailed:
+		return StatusFailed, change.Reason
+	}
+	return StatusDeployed, ""
+}
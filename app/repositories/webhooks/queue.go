@@ -0,0 +1,480 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/chechetech/app/azure-go/repositories/changes"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	StatusQueued     = "queued"
+	StatusProcessing = "processing"
+	StatusDeployed   = "deployed"
+	StatusHeld       = "held"
+	StatusCanary     = "canary"
+	StatusRejected   = "rejected"
+	StatusSuperseded = "superseded"
+	StatusFailed     = "failed"
+)
+
+const (
+	maxAttempts  = 6
+	firstBackoff = 2 * time.Second
+	maxBackoff   = 5 * time.Minute
+
+	// eventRetention is how long events are kept once they reached their
+	// outcome; a redelivery after that is processed again.
+	eventRetention = 7 * 24 * time.Hour
+	pruneInterval  = time.Hour
+)
+
+// Event is a registry notification, normalised by a Parser, and what
+// became of it.
+type Event struct {
+	ID         string    `json:"id"`
+	ReceivedAt time.Time `json:"receivedAt"`
+	Source     string    `json:"source"`
+	Action     string    `json:"action"`
+	Host       string    `json:"host"`
+	Repository string    `json:"repository"`
+	Tag        string    `json:"tag"`
+	Digest     string    `json:"digest,omitempty"`
+	Actor      string    `json:"actor,omitempty"`
+	Namespace  string    `json:"namespace,omitempty"`
+	Deployment string    `json:"deployment,omitempty"`
+	Container  string    `json:"container,omitempty"`
+	Image      string    `json:"image,omitempty"`
+
+	Status        string    `json:"status"`
+	Reason        string    `json:"reason,omitempty"`
+	Attempts      int       `json:"attempts"`
+	NextAttemptAt time.Time `json:"nextAttemptAt,omitempty"`
+	ChangeID      uint64    `json:"changeId,omitempty"`
+	HistoryID     uint64    `json:"historyId,omitempty"`
+	UpdatedAt     time.Time `json:"updatedAt"`
+
+	seq uint64
+}
+
+func (e Event) final() bool {
+	return e.Status != StatusQueued && e.Status != StatusProcessing
+}
+
+// done reports whether nothing more happens to the event; held and
+// canaried events still wait for their change.
+func (e Event) done() bool {
+	return e.final() && e.Status != StatusHeld && e.Status != StatusCanary
+}
+
+func (e Event) target() string {
+	return e.Namespace + "/" + e.Deployment
+}
+
+// ProcessFunc handles one event and returns it with Status and Reason set.
+// retry asks for another attempt after a backoff.
+type ProcessFunc func(event Event) (processed Event, retry bool)
+
+var (
+	eventsBucket  = []byte("webhook-events")
+	idsBucket     = []byte("webhook-ids")
+	pendingBucket = []byte("webhook-pending")
+)
+
+// Queue stores webhook events in bolt before they are processed, so an
+// event survives a restart and a redelivered ID is recognised. Events are
+// keyed by arrival order; a second bucket maps webhook IDs to that key, and
+// a third holds the keys of the events still queued or being processed, so
+// the workers only read those.
+type Queue struct {
+	db   *bolt.DB
+	wake chan struct{}
+}
+
+func NewQueue(db *bolt.DB) (*Queue, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(eventsBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(idsBucket); err != nil {
+			return err
+		}
+		if tx.Bucket(pendingBucket) != nil {
+			return nil
+		}
+
+		// Databases from before the pending bucket get one.
+		pending, err := tx.CreateBucket(pendingBucket)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(eventsBucket).ForEach(func(k, v []byte) error {
+			event, err := decodeEvent(k, v)
+			if err != nil || event.final() {
+				return err
+			}
+			return pending.Put(k, nil)
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create queue buckets: %w", err)
+	}
+
+	return &Queue{db: db, wake: make(chan struct{}, 1)}, nil
+}
+
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func putEvent(tx *bolt.Tx, event *Event) error {
+	event.UpdatedAt = time.Now()
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(eventsBucket).Put(itob(event.seq), data)
+}
+
+func decodeEvent(k, v []byte) (Event, error) {
+	var event Event
+	if err := json.Unmarshal(v, &event); err != nil {
+		return Event{}, err
+	}
+	event.seq = binary.BigEndian.Uint64(k)
+	return event, nil
+}
+
+// Enqueue stores event unless one with the same ID was already received,
+// in which case the stored event is returned with duplicate set. Events
+// that arrive already final, such as ones that could not be routed, are
+// only stored for the record.
+func (q *Queue) Enqueue(event Event) (stored Event, duplicate bool, err error) {
+	err = q.db.Update(func(tx *bolt.Tx) error {
+		if seq := tx.Bucket(idsBucket).Get([]byte(event.ID)); seq != nil {
+			duplicate = true
+			stored, err = decodeEvent(seq, tx.Bucket(eventsBucket).Get(seq))
+			return err
+		}
+
+		seq, err := tx.Bucket(eventsBucket).NextSequence()
+		if err != nil {
+			return err
+		}
+		event.seq = seq
+		if event.Status == "" {
+			event.Status = StatusQueued
+		}
+		if err := tx.Bucket(idsBucket).Put([]byte(event.ID), itob(seq)); err != nil {
+			return err
+		}
+		if !event.final() {
+			if err := tx.Bucket(pendingBucket).Put(itob(seq), nil); err != nil {
+				return err
+			}
+		}
+		stored = event
+		return putEvent(tx, &stored)
+	})
+	if err != nil {
+		return Event{}, false, fmt.Errorf("failed to enqueue event: %w", err)
+	}
+
+	if !duplicate && !stored.final() {
+		q.notify()
+	}
+	return stored, duplicate, nil
+}
+
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Get returns the event with a webhook ID.
+func (q *Queue) Get(id string) (Event, bool, error) {
+	var event Event
+	var found bool
+	err := q.db.View(func(tx *bolt.Tx) error {
+		seq := tx.Bucket(idsBucket).Get([]byte(id))
+		if seq == nil {
+			return nil
+		}
+		found = true
+		var err error
+		event, err = decodeEvent(seq, tx.Bucket(eventsBucket).Get(seq))
+		return err
+	})
+	if err != nil {
+		return Event{}, false, fmt.Errorf("failed to read event: %w", err)
+	}
+	return event, found, nil
+}
+
+// List returns up to limit events of a namespace, newest first.
+func (q *Queue) List(namespace string, limit int) ([]Event, error) {
+	events := []Event{}
+	err := q.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(eventsBucket).Cursor()
+		for k, v := cursor.Last(); k != nil && len(events) < limit; k, v = cursor.Prev() {
+			event, err := decodeEvent(k, v)
+			if err != nil {
+				return err
+			}
+			if event.Namespace == namespace {
+				events = append(events, event)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read events: %w", err)
+	}
+	return events, nil
+}
+
+// Run processes queued events with workers goroutines until ctx is done.
+// Events for the same deployment are processed one at a time and in the
+// order they arrived, so a retried push can't land after a newer one.
+func (q *Queue) Run(ctx context.Context, workers int, process ProcessFunc) {
+	if err := q.requeueInterrupted(); err != nil {
+		fmt.Printf("Error requeueing events: %v\n", err)
+	}
+
+	jobs := make(chan Event)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for event := range jobs {
+				q.finish(process(event))
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(time.Second)
+	pruneTicker := time.NewTicker(pruneInterval)
+	defer func() {
+		ticker.Stop()
+		pruneTicker.Stop()
+		close(jobs)
+		wg.Wait()
+	}()
+
+	for {
+		due, err := q.claimDue()
+		if err != nil {
+			fmt.Printf("Error reading queue: %v\n", err)
+		}
+		for _, event := range due {
+			select {
+			case jobs <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		case <-pruneTicker.C:
+			if err := q.prune(); err != nil {
+				fmt.Printf("Error pruning events: %v\n", err)
+			}
+		}
+	}
+}
+
+// requeueInterrupted puts back events that were being processed when the
+// server stopped. Those Settle moved on meanwhile are no longer pending.
+func (q *Queue) requeueInterrupted() error {
+	return q.db.Update(func(tx *bolt.Tx) error {
+		events, pending := tx.Bucket(eventsBucket), tx.Bucket(pendingBucket)
+		var settled [][]byte
+		err := pending.ForEach(func(k, _ []byte) error {
+			event, err := decodeEvent(k, events.Get(k))
+			if err != nil {
+				return err
+			}
+			if event.final() {
+				settled = append(settled, k)
+				return nil
+			}
+			if event.Status != StatusProcessing {
+				return nil
+			}
+			event.Status = StatusQueued
+			return putEvent(tx, &event)
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range settled {
+			if err := pending.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// claimDue marks the oldest waiting event of every idle deployment as
+// processing and returns the ones whose backoff has passed.
+func (q *Queue) claimDue() ([]Event, error) {
+	var due []Event
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		events := tx.Bucket(eventsBucket)
+		busy := map[string]bool{}
+		var oldest []Event
+		err := tx.Bucket(pendingBucket).ForEach(func(k, _ []byte) error {
+			event, err := decodeEvent(k, events.Get(k))
+			if err != nil || busy[event.target()] {
+				return err
+			}
+			busy[event.target()] = true
+			if event.Status == StatusQueued {
+				oldest = append(oldest, event)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		for _, event := range oldest {
+			if event.NextAttemptAt.After(now) {
+				continue
+			}
+			event.Status = StatusProcessing
+			event.Attempts++
+			if err := putEvent(tx, &event); err != nil {
+				return err
+			}
+			due = append(due, event)
+		}
+		return nil
+	})
+	return due, err
+}
+
+func (q *Queue) finish(event Event, retry bool) {
+	if retry && event.Attempts < maxAttempts {
+		backoff := firstBackoff << (event.Attempts - 1)
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+		event.Status = StatusQueued
+		event.NextAttemptAt = time.Now().Add(backoff)
+	} else if event.Status == StatusQueued || event.Status == StatusProcessing {
+		event.Status = StatusFailed
+	}
+
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		// The change can move on before the event is stored as held or
+		// canaried; Settle has stored where it got to then.
+		if event.Status == StatusHeld || event.Status == StatusCanary {
+			stored, err := decodeEvent(itob(event.seq), tx.Bucket(eventsBucket).Get(itob(event.seq)))
+			if err != nil {
+				return err
+			}
+			if stored.Status != StatusProcessing {
+				event.Status, event.Reason, event.HistoryID = stored.Status, stored.Reason, stored.HistoryID
+			}
+		}
+
+		if event.final() {
+			if err := tx.Bucket(pendingBucket).Delete(itob(event.seq)); err != nil {
+				return err
+			}
+		}
+		return putEvent(tx, &event)
+	})
+	if err != nil {
+		fmt.Printf("Error storing event %s: %v\n", event.ID, err)
+	}
+
+	fmt.Printf("Webhook event %s: %s %s\n", event.ID, event.Status, event.Reason)
+	q.notify()
+}
+
+// Settle moves the event that submitted change on with it, for changes
+// held or canaried that were since decided, superseded, promoted or failed.
+// It is a hook for changes.Manager.OnUpdate.
+func (q *Queue) Settle(change changes.Change) {
+	if change.WebhookID == "" {
+		return
+	}
+
+	status, reason := eventStatus(change)
+	err := q.db.Update(func(tx *bolt.Tx) error {
+		seq := tx.Bucket(idsBucket).Get([]byte(change.WebhookID))
+		if seq == nil {
+			return nil
+		}
+		event, err := decodeEvent(seq, tx.Bucket(eventsBucket).Get(seq))
+		if err != nil {
+			return err
+		}
+		// An event still being processed stays pending, so the next event
+		// of the deployment waits for it; finish keeps this status.
+		if event.Status != StatusHeld && event.Status != StatusCanary && event.Status != StatusProcessing {
+			return nil
+		}
+
+		event.Status, event.Reason, event.ChangeID = status, reason, change.ID
+		if change.HistoryID != 0 {
+			event.HistoryID = change.HistoryID
+		}
+		return putEvent(tx, &event)
+	})
+	if err != nil {
+		fmt.Printf("Error storing event %s: %v\n", change.WebhookID, err)
+	}
+}
+
+// prune deletes the events that were done more than eventRetention ago.
+func (q *Queue) prune() error {
+	cutoff := time.Now().Add(-eventRetention)
+	return q.db.Update(func(tx *bolt.Tx) error {
+		events := tx.Bucket(eventsBucket)
+		var expired []Event
+		cursor := events.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			event, err := decodeEvent(k, v)
+			if err != nil {
+				return err
+			}
+			// Keys follow arrival, so the rest are newer still.
+			if event.ReceivedAt.After(cutoff) {
+				break
+			}
+			if event.done() && event.UpdatedAt.Before(cutoff) {
+				expired = append(expired, event)
+			}
+		}
+
+		for _, event := range expired {
+			if err := events.Delete(itob(event.seq)); err != nil {
+				return err
+			}
+			if err := tx.Bucket(idsBucket).Delete([]byte(event.ID)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
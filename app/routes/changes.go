@@ -0,0 +1,70 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/chechetech/app/azure-go/repositories/changes"
+	"github.com/gin-gonic/gin"
+)
+
+func RegisterChangesRoutes(r *gin.Engine) {
+	r.GET("/changes", func(c *gin.Context) {
+		namespace, ok := getNamespace(c)
+		if !ok {
+			return
+		}
+
+		changeManager, ok := getChanges(c)
+		if !ok {
+			return
+		}
+
+		all, err := strconv.ParseBool(c.Query("all"))
+		if err != nil {
+			all = false
+		}
+
+		list, err := changeManager.List(namespace, all)
+		if err != nil {
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to get changes: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, list)
+	})
+
+	decisions := map[string]func(m *changes.Manager, namespace string, id uint64, actor string) (changes.Change, error){
+		"approve": (*changes.Manager).Approve,
+		"reject":  (*changes.Manager).Reject,
+	}
+
+	for decision, decide := range decisions {
+		r.POST("/changes/:id/"+decision, func(c *gin.Context) {
+			namespace, ok := getNamespace(c)
+			if !ok {
+				return
+			}
+
+			changeManager, ok := getChanges(c)
+			if !ok {
+				return
+			}
+
+			id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "invalid change id"})
+				return
+			}
+
+			change, err := decide(changeManager, namespace, id, c.GetString("actor"))
+			if err != nil {
+				c.JSON(statusForError(err), gin.H{"error": fmt.Sprintf("Failed to %s change: %v", decision, err)})
+				return
+			}
+
+			c.JSON(http.StatusOK, change)
+		})
+	}
+}
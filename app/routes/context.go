@@ -0,0 +1,128 @@
+package routes
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/chechetech/app/azure-go/config"
+	"github.com/chechetech/app/azure-go/repositories/cache"
+	"github.com/chechetech/app/azure-go/repositories/changes"
+	"github.com/chechetech/app/azure-go/repositories/deployments"
+	"github.com/chechetech/app/azure-go/repositories/history"
+	"github.com/chechetech/app/azure-go/repositories/notifications"
+	"github.com/chechetech/app/azure-go/repositories/pods"
+	"github.com/chechetech/app/azure-go/repositories/webhooks"
+	"github.com/gin-gonic/gin"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes"
+)
+
+// The helpers below fetch what the middlewares stored on the context and
+// answer with a 500 when it is missing, so handlers can simply return.
+
+func getClientset(c *gin.Context) (*kubernetes.Clientset, bool) {
+	getClientset, exists := c.Get("clientset")
+	if !exists {
+		c.JSON(500, gin.H{"error": "clientset not found"})
+		return nil, false
+	}
+	return getClientset.(*kubernetes.Clientset), true
+}
+
+func getNamespace(c *gin.Context) (string, bool) {
+	getNamespace, exists := c.Get("namespace")
+	if !exists {
+		c.JSON(500, gin.H{"error": "namespace not found"})
+		return "", false
+	}
+	return getNamespace.(string), true
+}
+
+func getConfig(c *gin.Context) (*config.Config, bool) {
+	getConfig, exists := c.Get("config")
+	if !exists {
+		c.JSON(500, gin.H{"error": "config not found"})
+		return nil, false
+	}
+	return getConfig.(*config.Config), true
+}
+
+func getRollouts(c *gin.Context) (*deployments.RolloutTracker, bool) {
+	getRollouts, exists := c.Get("rollouts")
+	if !exists {
+		c.JSON(500, gin.H{"error": "rollout tracker not found"})
+		return nil, false
+	}
+	return getRollouts.(*deployments.RolloutTracker), true
+}
+
+func getHistory(c *gin.Context) (*history.Store, bool) {
+	getHistory, exists := c.Get("history")
+	if !exists {
+		c.JSON(500, gin.H{"error": "history store not found"})
+		return nil, false
+	}
+	return getHistory.(*history.Store), true
+}
+
+func getChanges(c *gin.Context) (*changes.Manager, bool) {
+	getChanges, exists := c.Get("changes")
+	if !exists {
+		c.JSON(500, gin.H{"error": "change manager not found"})
+		return nil, false
+	}
+	return getChanges.(*changes.Manager), true
+}
+
+func getWebhooks(c *gin.Context) (*webhooks.Queue, bool) {
+	getWebhooks, exists := c.Get("webhooks")
+	if !exists {
+		c.JSON(500, gin.H{"error": "webhook queue not found"})
+		return nil, false
+	}
+	return getWebhooks.(*webhooks.Queue), true
+}
+
+func getNotifier(c *gin.Context) (*notifications.Notifier, bool) {
+	getNotifier, exists := c.Get("notifier")
+	if !exists {
+		c.JSON(500, gin.H{"error": "notifier not found"})
+		return nil, false
+	}
+	return getNotifier.(*notifications.Notifier), true
+}
+
+func getCache(c *gin.Context) (*cache.Cache, bool) {
+	getCache, exists := c.Get("cache")
+	if !exists {
+		c.JSON(500, gin.H{"error": "cache not found"})
+		return nil, false
+	}
+	return getCache.(*cache.Cache), true
+}
+
+func getPodWatcher(c *gin.Context) (*pods.Watcher, bool) {
+	getPodWatcher, exists := c.Get("podWatcher")
+	if !exists {
+		c.JSON(500, gin.H{"error": "pod watcher not found"})
+		return nil, false
+	}
+	return getPodWatcher.(*pods.Watcher), true
+}
+
+// statusForError picks the response code for an error from the
+// repositories, keeping what the API server said about bad requests,
+// missing objects, conflicts and expired continue tokens.
+func statusForError(err error) int {
+	switch {
+	case apierrors.IsBadRequest(err), errors.Is(err, pods.ErrInvalidFilter), errors.Is(err, pods.ErrTooManySources):
+		return http.StatusBadRequest
+	case apierrors.IsResourceExpired(err):
+		return http.StatusGone
+	case apierrors.IsNotFound(err), errors.Is(err, deployments.ErrRevisionNotFound), errors.Is(err, changes.ErrChangeNotFound):
+		return http.StatusNotFound
+	case apierrors.IsConflict(err), errors.Is(err, changes.ErrChangeDecided):
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
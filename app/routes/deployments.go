@@ -0,0 +1,637 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chechetech/app/azure-go/config"
+	"github.com/chechetech/app/azure-go/repositories/changes"
+	"github.com/chechetech/app/azure-go/repositories/deployments"
+	"github.com/chechetech/app/azure-go/repositories/history"
+	"github.com/chechetech/app/azure-go/repositories/registries"
+	"github.com/gin-gonic/gin"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes"
+)
+
+// CustomDeploymentStatus is a custom struct to hold the desired fields
+type CustomDeploymentStatus struct {
+	Name              string                    `json:"name"`
+	Replicas          int32                     `json:"replicas"`
+	UpdatedReplicas   int32                     `json:"updatedReplicas"`
+	ReadyReplicas     int32                     `json:"readyReplicas"`
+	AvailableReplicas int32                     `json:"availableReplicas"`
+	Images            []registries.RunningImage `json:"images"`
+	Conditions        []CustomCondition         `json:"conditions"`
+	Revision          int64                     `json:"revision"`
+	Paused            bool                      `json:"paused"`
+	LastUpdateTime    *time.Time                `json:"lastUpdateTime,omitempty"`
+}
+
+type CustomCondition struct {
+	Type           string    `json:"type"`
+	Status         string    `json:"status"`
+	Reason         string    `json:"reason,omitempty"`
+	Message        string    `json:"message,omitempty"`
+	LastUpdateTime time.Time `json:"lastUpdateTime"`
+}
+
+type CustomReplicaSetStatus struct {
+	Name              string                    `json:"name"`
+	Revision          int64                     `json:"revision"`
+	Replicas          int32                     `json:"replicas"`
+	ReadyReplicas     int32                     `json:"readyReplicas"`
+	AvailableReplicas int32                     `json:"availableReplicas"`
+	Images            []registries.RunningImage `json:"images"`
+	CreationTime      time.Time                 `json:"creationTime"`
+}
+
+type CustomDeploymentDetail struct {
+	CustomDeploymentStatus
+	ReplicaSets []CustomReplicaSetStatus `json:"replicaSets"`
+	Pods        []CustomPodStatus        `json:"pods"`
+	Events      []CustomEvent            `json:"events"`
+}
+
+// CustomEvent is an event about a deployment, one of its ReplicaSets or
+// one of its pods.
+type CustomEvent struct {
+	Type     string    `json:"type"`
+	Reason   string    `json:"reason"`
+	Message  string    `json:"message"`
+	Kind     string    `json:"kind"`
+	Name     string    `json:"name"`
+	Count    int32     `json:"count"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+func newCustomEvent(event corev1.Event) CustomEvent {
+	count := event.Count
+	if event.Series != nil {
+		count = event.Series.Count
+	}
+	if count == 0 {
+		count = 1
+	}
+	return CustomEvent{
+		Type:     event.Type,
+		Reason:   event.Reason,
+		Message:  event.Message,
+		Kind:     event.InvolvedObject.Kind,
+		Name:     event.InvolvedObject.Name,
+		Count:    count,
+		LastSeen: deployments.LastSeen(event),
+	}
+}
+
+func newCustomDeploymentStatus(deployment appsv1.Deployment) CustomDeploymentStatus {
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+
+	status := CustomDeploymentStatus{
+		Name:              deployment.Name,
+		Replicas:          replicas,
+		UpdatedReplicas:   deployment.Status.UpdatedReplicas,
+		ReadyReplicas:     deployment.Status.ReadyReplicas,
+		AvailableReplicas: deployment.Status.AvailableReplicas,
+		Images:            registries.RunningImages(deployment.Spec.Template),
+		Conditions:        []CustomCondition{},
+		Revision:          deployments.Revision(&deployment.ObjectMeta),
+		Paused:            deployment.Spec.Paused,
+	}
+
+	for _, condition := range deployment.Status.Conditions {
+		status.Conditions = append(status.Conditions, CustomCondition{
+			Type:           string(condition.Type),
+			Status:         string(condition.Status),
+			Reason:         condition.Reason,
+			Message:        condition.Message,
+			LastUpdateTime: condition.LastUpdateTime.Time,
+		})
+		if status.LastUpdateTime == nil || condition.LastUpdateTime.Time.After(*status.LastUpdateTime) {
+			lastUpdateTime := condition.LastUpdateTime.Time
+			status.LastUpdateTime = &lastUpdateTime
+		}
+	}
+
+	return status
+}
+
+func newCustomReplicaSetStatus(replicaSet appsv1.ReplicaSet) CustomReplicaSetStatus {
+	return CustomReplicaSetStatus{
+		Name:              replicaSet.Name,
+		Revision:          deployments.Revision(&replicaSet.ObjectMeta),
+		Replicas:          replicaSet.Status.Replicas,
+		ReadyReplicas:     replicaSet.Status.ReadyReplicas,
+		AvailableReplicas: replicaSet.Status.AvailableReplicas,
+		Images:            registries.RunningImages(replicaSet.Spec.Template),
+		CreationTime:      replicaSet.CreationTimestamp.Time,
+	}
+}
+
+// ScaleRequest is the body of the scale endpoint.
+type ScaleRequest struct {
+	Replicas *int32 `json:"replicas" binding:"required"`
+}
+
+// ImageRequest is the body of the manual deploy endpoint. An empty Container
+// means the mapped container, or the first one.
+type ImageRequest struct {
+	Container string `json:"container"`
+	Image     string `json:"image" binding:"required"`
+}
+
+// recordHistory stores entry, marking it failed when err is set, and
+// returns it as stored. The change has already been attempted, so a failure
+// to record is only logged.
+func recordHistory(historyStore *history.Store, entry history.Entry, err error) history.Entry {
+	if err != nil {
+		entry.Result, entry.Reason = history.ResultFailed, err.Error()
+	}
+	entry.DurationMs = time.Since(entry.Time).Milliseconds()
+	recorded, recordErr := historyStore.Record(entry)
+	if recordErr != nil {
+		fmt.Printf("Error recording history: %v\n", recordErr)
+		return entry
+	}
+	return recorded
+}
+
+// RollbackRequest selects what to roll back to. Without fields the revision
+// before the current one is restored.
+type RollbackRequest struct {
+	Revision  int64  `json:"revision"`
+	HistoryID uint64 `json:"historyId"`
+}
+
+func RegisterDeploymentsRoutes(r *gin.Engine) {
+	r.GET("/deployments", func(c *gin.Context) {
+		clientset, ok := getClientset(c)
+		if !ok {
+			return
+		}
+
+		namespace, ok := getNamespace(c)
+		if !ok {
+			return
+		}
+
+		store, ok := getCache(c)
+		if !ok {
+			return
+		}
+
+		deploymentList, err := deployments.GetDeployments(clientset, store, namespace)
+		if err != nil {
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to get deployments: %v", err)})
+			return
+		}
+
+		customDeploymentStatuses := []CustomDeploymentStatus{}
+		for _, deployment := range deploymentList.Items {
+			customDeploymentStatuses = append(customDeploymentStatuses, newCustomDeploymentStatus(deployment))
+		}
+
+		c.JSON(http.StatusOK, customDeploymentStatuses)
+	})
+
+	r.GET("/deployments/:name", func(c *gin.Context) {
+		clientset, ok := getClientset(c)
+		if !ok {
+			return
+		}
+
+		namespace, ok := getNamespace(c)
+		if !ok {
+			return
+		}
+
+		store, ok := getCache(c)
+		if !ok {
+			return
+		}
+
+		deployment, err := deployments.GetDeployment(clientset, store, namespace, c.Param("name"))
+		if err != nil {
+			c.JSON(statusForError(err), gin.H{"error": fmt.Sprintf("Failed to get deployment: %v", err)})
+			return
+		}
+
+		replicaSets, err := deployments.GetReplicaSets(clientset, store, deployment)
+		if err != nil {
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to get replica sets: %v", err)})
+			return
+		}
+
+		pods, err := deployments.GetDeploymentPods(clientset, store, deployment, replicaSets)
+		if err != nil {
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to get pods: %v", err)})
+			return
+		}
+
+		events, err := deployments.GetDeploymentEvents(clientset, store, deployment, replicaSets, pods)
+		if err != nil {
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to get events: %v", err)})
+			return
+		}
+
+		detail := CustomDeploymentDetail{
+			CustomDeploymentStatus: newCustomDeploymentStatus(*deployment),
+			ReplicaSets:            []CustomReplicaSetStatus{},
+			Pods:                   []CustomPodStatus{},
+			Events:                 []CustomEvent{},
+		}
+		for _, replicaSet := range replicaSets {
+			detail.ReplicaSets = append(detail.ReplicaSets, newCustomReplicaSetStatus(replicaSet))
+		}
+		for _, pod := range pods {
+			detail.Pods = append(detail.Pods, newCustomPodStatus(pod))
+		}
+		for _, event := range events {
+			detail.Events = append(detail.Events, newCustomEvent(event))
+		}
+
+		c.JSON(http.StatusOK, detail)
+	})
+
+	r.GET("/deployments/:name/rollouts", func(c *gin.Context) {
+		namespace, ok := getNamespace(c)
+		if !ok {
+			return
+		}
+
+		rollouts, ok := getRollouts(c)
+		if !ok {
+			return
+		}
+
+		c.JSON(http.StatusOK, rollouts.List(namespace, c.Param("name")))
+	})
+
+	r.GET("/deployments/:name/history", func(c *gin.Context) {
+		namespace, ok := getNamespace(c)
+		if !ok {
+			return
+		}
+
+		historyStore, ok := getHistory(c)
+		if !ok {
+			return
+		}
+
+		limit := 50
+		if limitStr := c.Query("limit"); limitStr != "" {
+			parsedLimit, err := strconv.Atoi(limitStr)
+			if err == nil && parsedLimit > 0 {
+				limit = parsedLimit
+			}
+		}
+
+		entries, err := historyStore.List(namespace, c.Param("name"), limit)
+		if err != nil {
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to get history: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, entries)
+	})
+
+	r.POST("/deployments/:name/rollback", func(c *gin.Context) {
+		clientset, ok := getClientset(c)
+		if !ok {
+			return
+		}
+
+		namespace, ok := getNamespace(c)
+		if !ok {
+			return
+		}
+
+		historyStore, ok := getHistory(c)
+		if !ok {
+			return
+		}
+
+		notifier, ok := getNotifier(c)
+		if !ok {
+			return
+		}
+
+		changeManager, ok := getChanges(c)
+		if !ok {
+			return
+		}
+
+		var request RollbackRequest
+		if c.Request.ContentLength != 0 {
+			if err := c.ShouldBindJSON(&request); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		if request.Revision != 0 && request.HistoryID != 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "revision and historyId are mutually exclusive"})
+			return
+		}
+
+		deploymentName := c.Param("name")
+		entry := history.Entry{
+			Time:       time.Now(),
+			Action:     history.ActionRollback,
+			Actor:      c.GetString("actor"),
+			Namespace:  namespace,
+			Deployment: deploymentName,
+			Result:     history.ResultApplied,
+		}
+
+		var previous history.Entry
+		if request.HistoryID != 0 {
+			var found bool
+			var err error
+			previous, found, err = historyStore.Get(namespace, deploymentName, request.HistoryID)
+			if err != nil {
+				c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to get history: %v", err)})
+				return
+			}
+			if !found || previous.NewImage == "" {
+				c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("history entry %d has no image to roll back to", request.HistoryID)})
+				return
+			}
+		}
+
+		// Held changes and canaries would undo the rollback once they
+		// land, so they are superseded by it.
+		var response interface{}
+		err := changeManager.Override(namespace, deploymentName, "superseded by a rollback", func() error {
+			if request.HistoryID != 0 {
+				result, err := registries.UpdateDeploymentImage(clientset, namespace, deploymentName, registries.ImageUpdate{
+					Container: previous.Container,
+					Image:     previous.NewImage,
+					Tag:       previous.Tag,
+					Digest:    previous.Digest,
+				})
+				entry.Container, entry.OldImage = result.Container, result.PreviousImage
+				entry.NewImage, entry.Tag, entry.Digest = previous.NewImage, previous.Tag, previous.Digest
+				entry.Reason = fmt.Sprintf("restored image of history entry %d", request.HistoryID)
+				response = gin.H{"message": "Deployment rolled back", "image": previous.NewImage}
+				return err
+			}
+
+			result, err := deployments.Rollback(clientset, namespace, deploymentName, request.Revision)
+			entry.Container, entry.OldImage, entry.NewImage = result.Container, result.OldImage, result.NewImage
+			entry.Reason = fmt.Sprintf("restored revision %d", result.ToRevision)
+			response = result
+			return err
+		})
+
+		// Only deployments that exist get a history.
+		if !apierrors.IsNotFound(err) {
+			notifier.Notify(recordHistory(historyStore, entry, err))
+		}
+		if err != nil {
+			c.JSON(statusForError(err), gin.H{"error": fmt.Sprintf("Failed to roll back deployment: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, response)
+	})
+
+	// A manual deploy goes through the same checks as a registry push of the
+	// image: the repository must map to this deployment and the tag must
+	// pass its policy. It is then held, canaried, recorded and notified like
+	// any other change.
+	r.POST("/deployments/:name/image", func(c *gin.Context) {
+		clientset, ok := getClientset(c)
+		if !ok {
+			return
+		}
+
+		namespace, ok := getNamespace(c)
+		if !ok {
+			return
+		}
+
+		cfg, ok := getConfig(c)
+		if !ok {
+			return
+		}
+
+		changeManager, ok := getChanges(c)
+		if !ok {
+			return
+		}
+
+		var request ImageRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		deploymentName := c.Param("name")
+		host, repository, tag, digest := registries.ParseImage(request.Image)
+
+		target, mapping, err := registries.ResolveTarget(cfg, repository)
+		if err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		if target.Namespace != namespace || target.Deployment != deploymentName {
+			c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("repository %s deploys to %s/%s, not %s/%s", repository, target.Namespace, target.Deployment, namespace, deploymentName)})
+			return
+		}
+		if request.Container == "" {
+			request.Container = target.Container
+		} else if target.Container != "" && target.Container != request.Container {
+			c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("repository %s deploys to container %s", repository, target.Container)})
+			return
+		}
+
+		// Mappings only name repositories, so the image must also come from
+		// a configured registry or the one the container already runs from.
+		policy := cfg.TagPolicyFor(mapping)
+		registry := cfg.RegistryHost(host)
+		var current registries.RunningImage
+		if registry == nil || policy.OnlyNewer {
+			if current, err = registries.GetDeploymentImage(clientset, namespace, deploymentName, request.Container); err != nil {
+				c.JSON(statusForError(err), gin.H{"error": fmt.Sprintf("Failed to get deployment image: %v", err)})
+				return
+			}
+		}
+		if currentHost, _, _, _ := registries.ParseImage(current.Image); registry == nil && currentHost != host {
+			c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("registry %s is not configured and the deployment doesn't run from it", host)})
+			return
+		}
+		if err := registries.CheckTagPolicy(policy, "push", tag, current.Tag); err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+
+		// A mapping pinned to digests deploys by digest however the image
+		// was given; the registry is asked for the digest of a bare tag.
+		image := request.Image
+		if mode := cfg.ImageRefFor(mapping); mode != config.ImageRefTag {
+			if digest == "" {
+				if registry == nil || tag == "" {
+					c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("repository %s is deployed by digest, give the image with one", repository)})
+					return
+				}
+				if digest, err = registries.NewClient(*registry).Digest(c.Request.Context(), repository, tag); err != nil {
+					c.JSON(statusForRegistryError(err), gin.H{"error": fmt.Sprintf("Failed to get digest of %s: %v", tag, err)})
+					return
+				}
+			}
+			if image, err = registries.ImagePath(host, repository, tag, digest, mode); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		}
+
+		change, err := changeManager.Submit(changes.Change{
+			Action:     history.ActionDeploy,
+			Actor:      c.GetString("actor"),
+			Repository: repository,
+			Namespace:  namespace,
+			Deployment: deploymentName,
+			Container:  request.Container,
+			Image:      image,
+			Tag:        tag,
+			Digest:     digest,
+		})
+		if err != nil {
+			c.JSON(statusForError(err), gin.H{"error": fmt.Sprintf("Failed to deploy image: %v", err), "change": change})
+			return
+		}
+
+		code := http.StatusOK
+		if change.Status != changes.StatusApplied {
+			code = http.StatusAccepted
+		}
+		c.JSON(code, change)
+	})
+
+	r.POST("/deployments/:name/scale", func(c *gin.Context) {
+		clientset, ok := getClientset(c)
+		if !ok {
+			return
+		}
+
+		namespace, ok := getNamespace(c)
+		if !ok {
+			return
+		}
+
+		historyStore, ok := getHistory(c)
+		if !ok {
+			return
+		}
+
+		changeManager, ok := getChanges(c)
+		if !ok {
+			return
+		}
+
+		var request ScaleRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if *request.Replicas < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "replicas must not be negative"})
+			return
+		}
+
+		entry := history.Entry{
+			Time:       time.Now(),
+			Action:     history.ActionScale,
+			Actor:      c.GetString("actor"),
+			Namespace:  namespace,
+			Deployment: c.Param("name"),
+			Result:     history.ResultApplied,
+		}
+
+		var previous int32
+		err := changeManager.Do(namespace, entry.Deployment, func() error {
+			var err error
+			previous, err = deployments.Scale(clientset, namespace, entry.Deployment, *request.Replicas)
+			return err
+		})
+		entry.Reason = fmt.Sprintf("scaled from %d to %d replicas", previous, *request.Replicas)
+		// Only deployments that exist get a history.
+		if !apierrors.IsNotFound(err) {
+			recordHistory(historyStore, entry, err)
+		}
+		if err != nil {
+			c.JSON(statusForError(err), gin.H{"error": fmt.Sprintf("Failed to scale deployment: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"message": "Deployment scaled", "previousReplicas": previous, "replicas": *request.Replicas})
+	})
+
+	actions := []struct {
+		path    string
+		action  string
+		message string
+		apply   func(clientset *kubernetes.Clientset, namespace, name string) error
+	}{
+		{"restart", history.ActionRestart, "Deployment restarted", deployments.Restart},
+		{"pause", history.ActionPause, "Deployment paused", func(clientset *kubernetes.Clientset, namespace, name string) error {
+			return deployments.SetPaused(clientset, namespace, name, true)
+		}},
+		{"resume", history.ActionResume, "Deployment resumed", func(clientset *kubernetes.Clientset, namespace, name string) error {
+			return deployments.SetPaused(clientset, namespace, name, false)
+		}},
+	}
+
+	for _, action := range actions {
+		r.POST("/deployments/:name/"+action.path, func(c *gin.Context) {
+			clientset, ok := getClientset(c)
+			if !ok {
+				return
+			}
+
+			namespace, ok := getNamespace(c)
+			if !ok {
+				return
+			}
+
+			historyStore, ok := getHistory(c)
+			if !ok {
+				return
+			}
+
+			changeManager, ok := getChanges(c)
+			if !ok {
+				return
+			}
+
+			entry := history.Entry{
+				Time:       time.Now(),
+				Action:     action.action,
+				Actor:      c.GetString("actor"),
+				Namespace:  namespace,
+				Deployment: c.Param("name"),
+				Result:     history.ResultApplied,
+			}
+
+			err := changeManager.Do(namespace, entry.Deployment, func() error {
+				return action.apply(clientset, namespace, entry.Deployment)
+			})
+			if !apierrors.IsNotFound(err) {
+				recordHistory(historyStore, entry, err)
+			}
+			if err != nil {
+				c.JSON(statusForError(err), gin.H{"error": fmt.Sprintf("Failed to %s deployment: %v", action.path, err)})
+				return
+			}
+
+			c.JSON(http.StatusOK, gin.H{"message": action.message})
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package routes
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func RegisterHealthRoutes(r *gin.Engine) {
+	// Readiness only depends on the process and does not reflect whether
+	// the informer caches have synced; that is only reported by GET /cache.
+	// Reads fall back to the API server until the cache of their namespace
+	// has synced, so a namespace that is slow to sync, or never does
+	// because its events can't be watched, doesn't make the server unready.
+	r.GET("/readyz", func(c *gin.Context) {
+		if _, ok := getCache(c); !ok {
+			return
+		}
+
+		c.JSON(http.StatusOK, gin.H{"ready": true})
+	})
+}
+
+func RegisterCacheRoutes(r *gin.Engine) {
+	// Reports the sync state of the informer cache of the token's
+	// namespace. A namespace is only cached once a request reads it.
+	r.GET("/cache", func(c *gin.Context) {
+		namespace, ok := getNamespace(c)
+		if !ok {
+			return
+		}
+
+		store, ok := getCache(c)
+		if !ok {
+			return
+		}
+
+		status, cached := store.NamespaceStatus(namespace)
+		c.JSON(http.StatusOK, gin.H{"cached": cached, "ready": cached && status.Ready(), "status": status})
+	})
+}
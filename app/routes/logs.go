@@ -0,0 +1,419 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chechetech/app/azure-go/repositories/deployments"
+	repo "github.com/chechetech/app/azure-go/repositories/pods"
+	"github.com/gin-gonic/gin"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+)
+
+// RegisterLogsRoutes registers the logs of several pods at once. They take
+// the query parameters of /pods/:name/logs, with container limiting them to
+// containers of that name, and prefix each line with its pod and container.
+// Timestamps are shown unless timestamps=false. Followed logs also pick up
+// pods that start later, such as those of a rollout.
+func RegisterLogsRoutes(r *gin.Engine) {
+	r.GET("/deployments/:name/logs", func(c *gin.Context) {
+		clientset, ok := getClientset(c)
+		if !ok {
+			return
+		}
+
+		namespace, ok := getNamespace(c)
+		if !ok {
+			return
+		}
+
+		store, ok := getCache(c)
+		if !ok {
+			return
+		}
+
+		deployment, err := deployments.GetDeployment(clientset, store, namespace, c.Param("name"))
+		if err != nil {
+			c.JSON(statusForError(err), gin.H{"error": fmt.Sprintf("Failed to get deployment: %v", err)})
+			return
+		}
+
+		aggregateLogs(c, clientset, namespace, func(pod *corev1.Pod) bool {
+			return deployments.OwnsPod(deployment, pod)
+		}, func() ([]corev1.Pod, error) {
+			replicaSets, err := deployments.GetReplicaSets(clientset, store, deployment)
+			if err != nil {
+				return nil, err
+			}
+			return deployments.GetDeploymentPods(clientset, store, deployment, replicaSets)
+		})
+	})
+
+	r.GET("/logs", func(c *gin.Context) {
+		clientset, ok := getClientset(c)
+		if !ok {
+			return
+		}
+
+		namespace, ok := getNamespace(c)
+		if !ok {
+			return
+		}
+
+		store, ok := getCache(c)
+		if !ok {
+			return
+		}
+
+		// Without a selector this would follow the whole namespace.
+		if c.Query("labelSelector") == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "labelSelector is required"})
+			return
+		}
+		selector, err := labels.Parse(c.Query("labelSelector"))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid labelSelector: %v", err)})
+			return
+		}
+
+		aggregateLogs(c, clientset, namespace, func(pod *corev1.Pod) bool {
+			return selector.Matches(labels.Set(pod.Labels))
+		}, func() ([]corev1.Pod, error) {
+			pods, err := repo.GetPods(clientset, store, namespace, repo.Filter{LabelSelector: selector.String()})
+			if err != nil {
+				return nil, err
+			}
+			return pods.Items, nil
+		})
+	})
+}
+
+// aggregateLogs answers with the logs of the pods list returns, or when
+// following, of the pods match accepts as they come and go.
+func aggregateLogs(c *gin.Context, clientset *kubernetes.Clientset, namespace string, match func(*corev1.Pod) bool, list func() ([]corev1.Pod, error)) {
+	options := logOptions(c)
+	if c.Query("timestamps") == "" {
+		options.Timestamps = true
+	}
+	filter, err := logFilter(c, &options)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	writer, err := newLogWriter(c, options, filter, podContainerPrefix)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if options.Follow {
+		watcher, ok := getPodWatcher(c)
+		if !ok {
+			return
+		}
+		lines, err := watcher.FollowPods(c.Request.Context(), clientset, namespace, match, options.Container, options, filter)
+		if err != nil {
+			c.JSON(statusForError(err), gin.H{"error": fmt.Sprintf("Failed to follow logs: %v", err)})
+			return
+		}
+		streamLogLines(c, lines, filter.Until, writer)
+		return
+	}
+
+	pods, err := list()
+	if err != nil {
+		c.JSON(statusForError(err), gin.H{"error": fmt.Sprintf("Failed to get pods: %v", err)})
+		return
+	}
+	sources := repo.PodSources(pods, options.Container, options.Previous)
+	if len(sources) > repo.MaxLogSources {
+		c.JSON(http.StatusBadRequest, gin.H{"error": repo.ErrTooManySources.Error()})
+		return
+	}
+	writeLogLines(c, clientset, namespace, sources, options, filter, writer)
+}
+
+// filterLimitBytes bounds a filtered read of a log that is given no
+// tailLines or limitBytes.
+const filterLimitBytes = 10 << 20
+
+// logOptions reads the log query parameters: follow, container, previous,
+// sinceSeconds, sinceTime, timestamps, tailLines and limitBytes. tailLines
+// is 100 by default, unless logFilter drops it, and a negative one reads the
+// whole log. Both limit what is read before filtering.
+func logOptions(c *gin.Context) corev1.PodLogOptions {
+	options := corev1.PodLogOptions{Container: c.Query("container")}
+	options.Follow, _ = strconv.ParseBool(c.Query("follow"))
+	options.Previous, _ = strconv.ParseBool(c.Query("previous"))
+	options.Timestamps, _ = strconv.ParseBool(c.Query("timestamps"))
+
+	if sinceSecondsStr := c.Query("sinceSeconds"); sinceSecondsStr != "" {
+		parsedSinceSeconds, err := strconv.ParseInt(sinceSecondsStr, 10, 64)
+		if err == nil {
+			options.SinceSeconds = &parsedSinceSeconds
+		}
+	}
+
+	if sinceTimeStr := c.Query("sinceTime"); sinceTimeStr != "" {
+		parsedSinceTime, err := time.Parse(time.RFC3339, sinceTimeStr)
+		if err == nil {
+			options.SinceTime = &metav1.Time{Time: parsedSinceTime}
+		}
+	}
+
+	tailLines := int64(100)
+	if tailLinesStr := c.Query("tailLines"); tailLinesStr != "" {
+		parsedTailLines, err := strconv.ParseInt(tailLinesStr, 10, 64)
+		if err == nil {
+			tailLines = parsedTailLines
+		}
+	}
+	if tailLines >= 0 {
+		options.TailLines = &tailLines
+	}
+
+	if limitBytesStr := c.Query("limitBytes"); limitBytesStr != "" {
+		parsedLimitBytes, err := strconv.ParseInt(limitBytesStr, 10, 64)
+		if err == nil && parsedLimitBytes > 0 {
+			options.LimitBytes = &parsedLimitBytes
+		}
+	}
+
+	return options
+}
+
+// logFilter reads the filter query parameters: grep, regex, invert, level
+// and until. Filters search the log, so a read given one and no tailLines
+// scans all of it from sinceSeconds or sinceTime instead of its last 100
+// lines, up to limitBytes or filterLimitBytes. A stream resuming from the Last-Event-ID header, or from the
+// after parameter, reads the logs again from its earliest position and
+// skips the lines it already sent; after also takes a single time.
+func logFilter(c *gin.Context, options *corev1.PodLogOptions) (repo.LogFilter, error) {
+	filter := repo.LogFilter{Grep: c.Query("grep"), Level: c.Query("level")}
+	filter.Invert, _ = strconv.ParseBool(c.Query("invert"))
+
+	if regexStr := c.Query("regex"); regexStr != "" {
+		regex, err := regexp.Compile(regexStr)
+		if err != nil {
+			return filter, fmt.Errorf("invalid regex: %w", err)
+		}
+		filter.Regex = regex
+	}
+
+	if untilStr := c.Query("until"); untilStr != "" {
+		until, err := time.Parse(time.RFC3339, untilStr)
+		if err != nil {
+			return filter, fmt.Errorf("invalid until: %w", err)
+		}
+		filter.Until = &until
+	}
+
+	after := c.GetHeader("Last-Event-ID")
+	if after == "" {
+		after = c.Query("after")
+	}
+	if after != "" {
+		cursor, err := repo.ParseLogCursor(after)
+		if err != nil {
+			return filter, fmt.Errorf("invalid resume position: %w", err)
+		}
+		if !cursor.Empty() {
+			filter.Resume = repo.NewResume(cursor)
+			// The API server only takes whole seconds; the filter drops
+			// the lines in that second that were already sent.
+			options.SinceTime, options.SinceSeconds, options.TailLines = &metav1.Time{Time: cursor.Since()}, nil, nil
+		}
+	}
+
+	if filter.Active() && !options.Follow && c.Query("tailLines") == "" {
+		options.TailLines = nil
+		if options.LimitBytes == nil {
+			limitBytes := int64(filterLimitBytes)
+			options.LimitBytes = &limitBytes
+		}
+	}
+
+	return filter, filter.Validate()
+}
+
+// writeLogLines answers with the logs of sources. Read logs are merged by
+// time; followed logs are written as they arrive. limitBytes and tailLines
+// apply per container.
+func writeLogLines(c *gin.Context, clientset *kubernetes.Clientset, namespace string, sources []repo.LogSource, options corev1.PodLogOptions, filter repo.LogFilter, writer logWriter) {
+	ctx := c.Request.Context()
+	if !options.Follow {
+		lines, err := repo.ReadLogs(ctx, clientset, namespace, sources, options, filter)
+		if err != nil {
+			c.JSON(statusForError(err), gin.H{"error": fmt.Sprintf("Failed to get logs: %v", err)})
+			return
+		}
+		writer.write(c, lines)
+		return
+	}
+
+	lines, err := repo.FollowLogs(ctx, clientset, namespace, sources, options, filter)
+	if err != nil {
+		c.JSON(statusForError(err), gin.H{"error": fmt.Sprintf("Failed to get logs: %v", err)})
+		return
+	}
+	streamLogLines(c, lines, filter.Until, writer)
+}
+
+// streamLogLines writes lines as they arrive until the channel is closed,
+// or until passes.
+func streamLogLines(c *gin.Context, lines <-chan repo.LogLine, until *time.Time, writer logWriter) {
+	var deadline <-chan time.Time
+	if until != nil {
+		timer := time.NewTimer(time.Until(*until))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+
+	c.Header("Content-Type", writer.contentType())
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return false
+			}
+			io.WriteString(w, writer.format(line))
+		case <-heartbeat.C:
+			io.WriteString(w, writer.heartbeat())
+		case <-deadline:
+			return false
+		}
+		return true
+	})
+}
+
+// logWriter renders log lines as text, with prefix(source) and, when asked
+// for, timestamps, or with format=structured as parsed entries. Read logs
+// are plain text or a JSON array, or NDJSON when the request accepts
+// application/x-ndjson, with text lines as {"line": ...} objects.
+//
+// Followed logs are framed so that heartbeats can keep them open: as
+// Server-Sent Events when the request accepts text/event-stream, otherwise
+// as NDJSON. Each event is a line, with the cursor of the stream as its ID
+// to resume from.
+type logWriter struct {
+	structured bool
+	ndjson     bool
+	sse        bool
+	timestamps bool
+	prefix     func(repo.LogSource) string
+	cursor     repo.LogCursor
+}
+
+func newLogWriter(c *gin.Context, options corev1.PodLogOptions, filter repo.LogFilter, prefix func(repo.LogSource) string) (logWriter, error) {
+	writer := logWriter{timestamps: options.Timestamps, prefix: prefix}
+	switch format := c.DefaultQuery("format", "text"); format {
+	case "text":
+	case "structured":
+		writer.structured = true
+	default:
+		return writer, fmt.Errorf("unknown format %q, use text or structured", format)
+	}
+
+	writer.sse = options.Follow && strings.Contains(c.GetHeader("Accept"), "text/event-stream")
+	writer.ndjson = !writer.sse && (options.Follow || strings.Contains(c.GetHeader("Accept"), "application/x-ndjson"))
+
+	// A resumed stream carries on from the positions it resumed from, so
+	// sources that send nothing more keep theirs.
+	writer.cursor = repo.LogCursor{Positions: map[repo.LogSource]repo.LogPosition{}}
+	if filter.Resume != nil {
+		writer.cursor = filter.Resume.Cursor()
+	}
+	return writer, nil
+}
+
+func (w logWriter) contentType() string {
+	switch {
+	case w.sse:
+		return "text/event-stream"
+	case w.ndjson:
+		return "application/x-ndjson"
+	case w.structured:
+		return "application/json; charset=utf-8"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// format renders a line as text, NDJSON or an event.
+func (w logWriter) format(line repo.LogLine) string {
+	var text string
+	if w.structured {
+		entry, err := json.Marshal(repo.ParseEntry(line))
+		if err != nil {
+			// Fields came from JSON, so they encode again.
+			return ""
+		}
+		text = string(entry)
+	} else {
+		text = w.prefix(line.Source)
+		if w.timestamps && !line.Time.IsZero() {
+			text += line.Time.Format(time.RFC3339Nano) + " "
+		}
+		text += line.Text
+
+		if w.ndjson || w.sse {
+			object, _ := json.Marshal(gin.H{"line": text})
+			text = string(object)
+		}
+	}
+
+	if !w.sse {
+		return text + "\n"
+	}
+	w.cursor.Advance(line)
+	event := ""
+	if !w.cursor.Empty() {
+		event = "id: " + w.cursor.String() + "\n"
+	}
+	return event + "event: log\ndata: " + text + "\n\n"
+}
+
+// heartbeat is written to followed streams that have been quiet, as a
+// comment for events or an object NDJSON clients can skip.
+func (w logWriter) heartbeat() string {
+	if w.sse {
+		return ": heartbeat\n\n"
+	}
+	return `{"heartbeat":"` + time.Now().UTC().Format(time.RFC3339) + `"}` + "\n"
+}
+
+// write answers with lines that have been read.
+func (w logWriter) write(c *gin.Context, lines []repo.LogLine) {
+	if w.structured && !w.ndjson {
+		entries := []repo.LogEntry{}
+		for _, line := range lines {
+			entries = append(entries, repo.ParseEntry(line))
+		}
+		c.JSON(http.StatusOK, entries)
+		return
+	}
+
+	var logs strings.Builder
+	for _, line := range lines {
+		logs.WriteString(w.format(line))
+	}
+	c.Data(http.StatusOK, w.contentType(), []byte(logs.String()))
+}
+
+// podContainerPrefix tells apart the lines of several pods, like stern.
+func podContainerPrefix(source repo.LogSource) string {
+	return "[" + source.Pod + "/" + source.Container + "] "
+}
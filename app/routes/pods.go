@@ -1,163 +1,508 @@
 package routes
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	repo "github.com/chechetech/app/azure-go/repositories/pods"
+	"github.com/chechetech/app/azure-go/repositories/registries"
 	"github.com/gin-gonic/gin"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
+	"k8s.io/apimachinery/pkg/labels"
 )
 
-// CustomPodStatus is a custom struct to hold the desired fields
+// CustomPodStatus is a custom struct to hold the desired fields. Image and
+// Tag are those of the first container; Status is what `kubectl get pods`
+// shows, which unlike Phase tells a crash-looping pod from a running one.
 type CustomPodStatus struct {
-	Image     string    `json:"image"`
-	Name      string    `json:"name"`
-	Phase     string    `json:"phase"`
-	StartTime time.Time `json:"startTime"`
+	Image          string                  `json:"image"`
+	Tag            string                  `json:"tag,omitempty"`
+	Name           string                  `json:"name"`
+	Phase          string                  `json:"phase"`
+	Status         string                  `json:"status"`
+	Ready          string                  `json:"ready"`
+	Restarts       int32                   `json:"restarts"`
+	Reason         string                  `json:"reason,omitempty"`
+	Message        string                  `json:"message,omitempty"`
+	StartTime      *time.Time              `json:"startTime,omitempty"`
+	Node           string                  `json:"node,omitempty"`
+	PodIPs         []string                `json:"podIPs,omitempty"`
+	HostIP         string                  `json:"hostIP,omitempty"`
+	QOSClass       string                  `json:"qosClass,omitempty"`
+	Owner          *CustomOwner            `json:"owner,omitempty"`
+	Conditions     []CustomPodCondition    `json:"conditions"`
+	InitContainers []CustomContainerStatus `json:"initContainers,omitempty"`
+	Containers     []CustomContainerStatus `json:"containers"`
 }
 
-func RegisterPodsRoutes(r *gin.Engine) {
-	r.GET("/pods", func(c *gin.Context) {
-		// Set up Kubernetes client
+type CustomPodCondition struct {
+	Type               string    `json:"type"`
+	Status             string    `json:"status"`
+	Reason             string    `json:"reason,omitempty"`
+	Message            string    `json:"message,omitempty"`
+	LastTransitionTime time.Time `json:"lastTransitionTime"`
+}
 
-		getClientset, exists := c.Get("clientset")
-		if !exists {
-			c.JSON(500, gin.H{"error": "clientset not found"})
-			return
+// CustomOwner is the controller of a pod, usually a ReplicaSet.
+type CustomOwner struct {
+	Kind string `json:"kind"`
+	Name string `json:"name"`
+}
+
+// CustomContainerStatus merges a container of the pod spec with its status,
+// which is missing until the kubelet reports on it.
+type CustomContainerStatus struct {
+	Name            string                `json:"name"`
+	Image           string                `json:"image"`
+	Tag             string                `json:"tag,omitempty"`
+	ImageID         string                `json:"imageID,omitempty"`
+	Ready           bool                  `json:"ready"`
+	RestartCount    int32                 `json:"restartCount"`
+	State           *CustomContainerState `json:"state,omitempty"`
+	LastTermination *CustomContainerState `json:"lastTermination,omitempty"`
+}
+
+// CustomContainerState flattens corev1.ContainerState. State is waiting,
+// running or terminated; Reason is e.g. CrashLoopBackOff or OOMKilled.
+type CustomContainerState struct {
+	State      string     `json:"state"`
+	Reason     string     `json:"reason,omitempty"`
+	Message    string     `json:"message,omitempty"`
+	ExitCode   *int32     `json:"exitCode,omitempty"`
+	Signal     int32      `json:"signal,omitempty"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+func newCustomPodStatus(pod corev1.Pod) CustomPodStatus {
+	tags := registries.ImageTags(pod.Annotations)
+	customPodStatus := CustomPodStatus{
+		Name:           pod.Name,
+		Phase:          string(pod.Status.Phase),
+		Status:         podStatus(pod),
+		Reason:         pod.Status.Reason,
+		Message:        pod.Status.Message,
+		Node:           pod.Spec.NodeName,
+		HostIP:         pod.Status.HostIP,
+		QOSClass:       string(pod.Status.QOSClass),
+		Conditions:     []CustomPodCondition{},
+		InitContainers: newCustomContainerStatuses(pod.Spec.InitContainers, pod.Status.InitContainerStatuses, tags),
+		Containers:     newCustomContainerStatuses(pod.Spec.Containers, pod.Status.ContainerStatuses, tags),
+	}
+	if len(customPodStatus.Containers) > 0 {
+		customPodStatus.Image, customPodStatus.Tag = customPodStatus.Containers[0].Image, customPodStatus.Containers[0].Tag
+	}
+
+	ready := 0
+	for _, container := range customPodStatus.Containers {
+		if container.Ready {
+			ready++
 		}
-		clientset := getClientset.(*kubernetes.Clientset)
+		customPodStatus.Restarts += container.RestartCount
+	}
+	customPodStatus.Ready = fmt.Sprintf("%d/%d", ready, len(customPodStatus.Containers))
 
-		getNamespace, exists := c.Get("namespace")
-		if !exists {
-			c.JSON(500, gin.H{"error": "namespace not found"})
-			return
+	// Pods that haven't been scheduled yet have no start time.
+	if pod.Status.StartTime != nil {
+		customPodStatus.StartTime = &pod.Status.StartTime.Time
+	}
+	for _, ip := range pod.Status.PodIPs {
+		customPodStatus.PodIPs = append(customPodStatus.PodIPs, ip.IP)
+	}
+	if owner := metav1.GetControllerOf(&pod); owner != nil {
+		customPodStatus.Owner = &CustomOwner{Kind: owner.Kind, Name: owner.Name}
+	}
+	for _, condition := range pod.Status.Conditions {
+		customPodStatus.Conditions = append(customPodStatus.Conditions, CustomPodCondition{
+			Type:               string(condition.Type),
+			Status:             string(condition.Status),
+			Reason:             condition.Reason,
+			Message:            condition.Message,
+			LastTransitionTime: condition.LastTransitionTime.Time,
+		})
+	}
+
+	return customPodStatus
+}
+
+func newCustomContainerStatuses(containers []corev1.Container, statuses []corev1.ContainerStatus, tags map[string]registries.ImageTag) []CustomContainerStatus {
+	byName := map[string]corev1.ContainerStatus{}
+	for _, status := range statuses {
+		byName[status.Name] = status
+	}
+
+	customStatuses := make([]CustomContainerStatus, 0, len(containers))
+	for _, container := range containers {
+		customStatus := CustomContainerStatus{
+			Name:  container.Name,
+			Image: container.Image,
+			Tag:   tags[container.Name].Tag,
+		}
+		if status, ok := byName[container.Name]; ok {
+			customStatus.ImageID = status.ImageID
+			customStatus.Ready = status.Ready
+			customStatus.RestartCount = status.RestartCount
+			customStatus.State = newCustomContainerState(status.State)
+			customStatus.LastTermination = newCustomContainerState(status.LastTerminationState)
 		}
-		namespace := getNamespace.(string)
+		customStatuses = append(customStatuses, customStatus)
+	}
+	return customStatuses
+}
 
-		pods, err := repo.GetPods(clientset, namespace)
-		if err != nil {
-			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to get pods: %v", err)})
-			return
+func newCustomContainerState(state corev1.ContainerState) *CustomContainerState {
+	switch {
+	case state.Waiting != nil:
+		return &CustomContainerState{State: "waiting", Reason: state.Waiting.Reason, Message: state.Waiting.Message}
+	case state.Running != nil:
+		return &CustomContainerState{State: "running", StartedAt: optionalTime(state.Running.StartedAt)}
+	case state.Terminated != nil:
+		terminated := state.Terminated
+		return &CustomContainerState{
+			State:      "terminated",
+			Reason:     terminated.Reason,
+			Message:    terminated.Message,
+			ExitCode:   &terminated.ExitCode,
+			Signal:     terminated.Signal,
+			StartedAt:  optionalTime(terminated.StartedAt),
+			FinishedAt: optionalTime(terminated.FinishedAt),
 		}
-		// Create a slice to hold the custom pod statuses
-		var customPodStatuses []CustomPodStatus
+	}
+	return nil
+}
 
-		// Populate the custom pod statuses
-		for _, pod := range pods.Items {
-			customPodStatus := CustomPodStatus{
-				Image:     pod.Spec.Containers[0].Image,
-				Name:      pod.Name,
-				Phase:     string(pod.Status.Phase),
-				StartTime: pod.Status.StartTime.Time,
+// optionalTime leaves out times the kubelet hasn't set.
+func optionalTime(t metav1.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t.Time
+}
+
+// podStatus works out the STATUS column of `kubectl get pods`: the reason
+// of the first failing init container, else of the last container that is
+// not running, else the phase.
+func podStatus(pod corev1.Pod) string {
+	status := string(pod.Status.Phase)
+	if pod.Status.Reason != "" {
+		status = pod.Status.Reason
+	}
+
+	initializing := false
+	for i, container := range pod.Status.InitContainerStatuses {
+		switch {
+		case container.State.Terminated != nil && container.State.Terminated.ExitCode == 0:
+			continue
+		case container.State.Terminated != nil:
+			status = "Init:" + terminatedReason(container.State.Terminated)
+		case container.State.Waiting != nil && container.State.Waiting.Reason != "" && container.State.Waiting.Reason != "PodInitializing":
+			status = "Init:" + container.State.Waiting.Reason
+		default:
+			status = fmt.Sprintf("Init:%d/%d", i, len(pod.Spec.InitContainers))
+		}
+		initializing = true
+		break
+	}
+
+	if !initializing {
+		hasRunning := false
+		for i := len(pod.Status.ContainerStatuses) - 1; i >= 0; i-- {
+			container := pod.Status.ContainerStatuses[i]
+			switch {
+			case container.State.Waiting != nil && container.State.Waiting.Reason != "":
+				status = container.State.Waiting.Reason
+			case container.State.Terminated != nil:
+				status = terminatedReason(container.State.Terminated)
+			case container.Ready && container.State.Running != nil:
+				hasRunning = true
 			}
-			customPodStatuses = append(customPodStatuses, customPodStatus)
 		}
+		if status == "Completed" && hasRunning {
+			status = "Running"
+		}
+	}
 
-		c.JSON(http.StatusOK, customPodStatuses)
+	if pod.DeletionTimestamp != nil {
+		if pod.Status.Reason == "NodeLost" {
+			return "Unknown"
+		}
+		return "Terminating"
+	}
+	return status
+}
 
-	})
+func terminatedReason(terminated *corev1.ContainerStateTerminated) string {
+	switch {
+	case terminated.Reason != "":
+		return terminated.Reason
+	case terminated.Signal != 0:
+		return fmt.Sprintf("Signal:%d", terminated.Signal)
+	}
+	return fmt.Sprintf("ExitCode:%d", terminated.ExitCode)
+}
 
-	r.GET("/pods/:name/logs", func(c *gin.Context) {
+// streamHeartbeat keeps idle streams from being closed by proxies.
+const streamHeartbeat = 15 * time.Second
 
-		getClientset, exists := c.Get("clientset")
-		if !exists {
-			c.JSON(500, gin.H{"error": "clientset not found"})
-			return
+// CustomPodSnapshot is the first event of a pod watch.
+type CustomPodSnapshot struct {
+	ResourceVersion string            `json:"resourceVersion"`
+	Pods            []CustomPodStatus `json:"pods"`
+}
+
+// CustomPodEvent is a pod that was added, modified or deleted.
+type CustomPodEvent struct {
+	Type            string          `json:"type"`
+	ResourceVersion string          `json:"resourceVersion"`
+	Pod             CustomPodStatus `json:"pod"`
+}
+
+func newCustomPodEvent(event repo.WatchEvent) CustomPodEvent {
+	return CustomPodEvent{
+		Type:            strings.ToLower(string(event.Type)),
+		ResourceVersion: event.ResourceVersion,
+		Pod:             newCustomPodStatus(*event.Pod),
+	}
+}
+
+// writeEvent writes a Server-Sent Event with data as JSON.
+func writeEvent(w io.Writer, id, event string, data interface{}) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		fmt.Printf("Error encoding %s event: %v\n", event, err)
+		return
+	}
+	fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", id, event, body)
+}
+
+// podSorts are the orders GET /pods can sort by. Pods that haven't started
+// sort before those that have.
+var podSorts = map[string]func(a, b CustomPodStatus) bool{
+	"name":     func(a, b CustomPodStatus) bool { return a.Name < b.Name },
+	"status":   func(a, b CustomPodStatus) bool { return a.Status < b.Status },
+	"node":     func(a, b CustomPodStatus) bool { return a.Node < b.Node },
+	"restarts": func(a, b CustomPodStatus) bool { return a.Restarts < b.Restarts },
+	"startTime": func(a, b CustomPodStatus) bool {
+		if a.StartTime == nil || b.StartTime == nil {
+			return a.StartTime == nil && b.StartTime != nil
 		}
-		clientset := getClientset.(*kubernetes.Clientset)
+		return a.StartTime.Before(*b.StartTime)
+	},
+}
 
-		getNamespace, exists := c.Get("namespace")
-		if !exists {
-			c.JSON(500, gin.H{"error": "namespace not found"})
+func RegisterPodsRoutes(r *gin.Engine) {
+	// Filters and pages are passed through to the API server where it can
+	// apply them. The token for the next page is in the X-Continue header;
+	// sorting only orders the page that is returned.
+	r.GET("/pods", func(c *gin.Context) {
+		clientset, ok := getClientset(c)
+		if !ok {
 			return
 		}
-		namespace := getNamespace.(string)
 
-		fmt.Println("namespace", namespace)
+		namespace, ok := getNamespace(c)
+		if !ok {
+			return
+		}
 
-		podName := c.Param("name")
+		store, ok := getCache(c)
+		if !ok {
+			return
+		}
 
-		follow, err := strconv.ParseBool(c.Query("follow"))
-		if err != nil {
-			follow = false
+		filter := repo.Filter{
+			LabelSelector: c.Query("labelSelector"),
+			FieldSelector: c.Query("fieldSelector"),
+			Deployment:    c.Query("deployment"),
+			NamePrefix:    c.Query("prefix"),
+			Continue:      c.Query("continue"),
 		}
+		fieldSelectors := []string{}
+		if filter.FieldSelector != "" {
+			fieldSelectors = append(fieldSelectors, filter.FieldSelector)
+		}
+		if phase := c.Query("phase"); phase != "" {
+			fieldSelectors = append(fieldSelectors, "status.phase="+phase)
+		}
+		if node := c.Query("node"); node != "" {
+			fieldSelectors = append(fieldSelectors, "spec.nodeName="+node)
+		}
+		filter.FieldSelector = strings.Join(fieldSelectors, ",")
 
-		var sinceSeconds *int64
-		if sinceSecondsStr := c.Query("sinceSeconds"); sinceSecondsStr != "" {
-			parsedSinceSeconds, err := strconv.ParseInt(sinceSecondsStr, 10, 64)
-			if err == nil {
-				sinceSeconds = &parsedSinceSeconds
+		if limitStr := c.Query("limit"); limitStr != "" {
+			parsedLimit, err := strconv.ParseInt(limitStr, 10, 64)
+			if err == nil && parsedLimit > 0 {
+				filter.Limit = parsedLimit
 			}
 		}
 
-		var sinceTime *metav1.Time
-		if sinceTimeStr := c.Query("sinceTime"); sinceTimeStr != "" {
-			parsedSinceTime, err := time.Parse(time.RFC3339, sinceTimeStr)
-			fmt.Println("parsedSinceTime", parsedSinceTime)
-			if err == nil {
-				fmt.Println("error parsing time", err)
-				sinceTime = &metav1.Time{Time: parsedSinceTime}
-			}
+		less, ok := podSorts[c.DefaultQuery("sort", "name")]
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown sort %q", c.Query("sort"))})
+			return
 		}
 
-		timestamps, err := strconv.ParseBool(c.Query("timestamps"))
+		pods, err := repo.GetPods(clientset, store, namespace, filter)
 		if err != nil {
-			timestamps = false
+			c.JSON(statusForError(err), gin.H{"error": fmt.Sprintf("Failed to get pods: %v", err)})
+			return
 		}
 
-		var tailLines *int64
-		if tailLinesStr := c.Query("tailLines"); tailLinesStr != "" {
-			parsedTailLines, err := strconv.ParseInt(tailLinesStr, 10, 64)
-			if err == nil {
-				tailLines = &parsedTailLines
+		customPodStatuses := []CustomPodStatus{}
+		for _, pod := range pods.Items {
+			customPodStatuses = append(customPodStatuses, newCustomPodStatus(pod))
+		}
+
+		descending := c.Query("order") == "desc"
+		sort.SliceStable(customPodStatuses, func(i, j int) bool {
+			if descending {
+				return less(customPodStatuses[j], customPodStatuses[i])
 			}
-		} else {
-			defaultTailLines := int64(100)
-			tailLines = &defaultTailLines
+			return less(customPodStatuses[i], customPodStatuses[j])
+		})
+
+		if pods.Continue != "" {
+			c.Header("X-Continue", pods.Continue)
+		}
+		c.JSON(http.StatusOK, customPodStatuses)
+	})
+
+	// Streams changes to the pods of the namespace as Server-Sent Events.
+	// The first event is a snapshot of every pod, then each added, modified
+	// or deleted pod follows with its resource version as the event ID. A
+	// client reconnecting with Last-Event-ID, or ?resourceVersion=, gets the
+	// events it missed instead of a new snapshot while they are still kept.
+	r.GET("/pods/watch", func(c *gin.Context) {
+		namespace, ok := getNamespace(c)
+		if !ok {
+			return
 		}
 
-		bufferSize := int64(16384)
+		watcher, ok := getPodWatcher(c)
+		if !ok {
+			return
+		}
 
-		logStream, logs, err := repo.GetPodLogs(clientset, namespace, podName, follow, sinceSeconds, sinceTime, timestamps, tailLines, bufferSize)
+		selector, err := labels.Parse(c.Query("labelSelector"))
 		if err != nil {
-			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to get logs: %v", err)})
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid labelSelector: %v", err)})
 			return
 		}
 
-		if follow {
-			fmt.Println("streaming started.")
-			defer logStream.Close()
+		resourceVersion := c.GetHeader("Last-Event-ID")
+		if resourceVersion == "" {
+			resourceVersion = c.Query("resourceVersion")
+		}
 
-			ctx := c.Request.Context()
+		ctx := c.Request.Context()
+		subscription, err := watcher.Subscribe(ctx, namespace, resourceVersion)
+		if err != nil {
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to watch pods: %v", err)})
+			return
+		}
 
-			go func() {
-				<-ctx.Done()
-				fmt.Println("client disconnected, closing stream.")
-				logStream.Close()
-			}()
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(http.StatusOK)
 
-			c.Stream(func(w io.Writer) bool {
-				buf := make([]byte, bufferSize)
-				numBytes, err := logStream.Read(buf)
-				if err != nil {
+		if !subscription.Resumed {
+			snapshot := CustomPodSnapshot{ResourceVersion: subscription.Version, Pods: []CustomPodStatus{}}
+			for _, pod := range subscription.Snapshot {
+				if selector.Matches(labels.Set(pod.Labels)) {
+					snapshot.Pods = append(snapshot.Pods, newCustomPodStatus(*pod))
+				}
+			}
+			writeEvent(c.Writer, subscription.Version, "snapshot", snapshot)
+		}
+		for _, event := range subscription.Replay {
+			if selector.Matches(labels.Set(event.Pod.Labels)) {
+				writeEvent(c.Writer, event.ResourceVersion, strings.ToLower(string(event.Type)), newCustomPodEvent(event))
+			}
+		}
+		c.Writer.Flush()
+
+		heartbeat := time.NewTicker(streamHeartbeat)
+		defer heartbeat.Stop()
+
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case event, ok := <-subscription.Events:
+				if !ok {
 					return false
 				}
-				if numBytes > 0 {
-					c.Writer.Write(buf[:numBytes])
+				if selector.Matches(labels.Set(event.Pod.Labels)) {
+					writeEvent(w, event.ResourceVersion, strings.ToLower(string(event.Type)), newCustomPodEvent(event))
 				}
-				fmt.Println("streaming ending.")
-				return true
+			case <-heartbeat.C:
+				fmt.Fprint(w, ": heartbeat\n\n")
+			case <-ctx.Done():
+				return false
+			}
+			return true
+		})
+	})
 
-			})
-		} else {
-			c.String(200, logs)
+	r.GET("/pods/:name/logs", func(c *gin.Context) {
+		clientset, ok := getClientset(c)
+		if !ok {
+			return
+		}
+
+		namespace, ok := getNamespace(c)
+		if !ok {
+			return
+		}
+
+		store, ok := getCache(c)
+		if !ok {
+			return
+		}
+
+		podName := c.Param("name")
+		options := logOptions(c)
+		filter, err := logFilter(c, &options)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		allContainers, _ := strconv.ParseBool(c.Query("allContainers"))
+		writer, err := newLogWriter(c, options, filter, func(source repo.LogSource) string {
+			if allContainers {
+				return "[" + source.Container + "] "
+			}
+			return ""
+		})
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		// Pods with sidecars need a container, which is the default one
+		// unless the request names it.
+		sources := []repo.LogSource{{Pod: podName, Container: options.Container}}
+		if allContainers || options.Container == "" {
+			pod, err := repo.GetPod(clientset, store, namespace, podName)
+			if err != nil {
+				c.JSON(statusForError(err), gin.H{"error": fmt.Sprintf("Failed to get pod: %v", err)})
+				return
+			}
+			if allContainers {
+				sources = repo.ContainerSources(pod, options.Previous)
+			} else {
+				sources[0].Container = repo.DefaultContainer(pod)
+			}
 		}
 
+		writeLogLines(c, clientset, namespace, sources, options, filter, writer)
 	})
 
 }
@@ -0,0 +1,92 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/chechetech/app/azure-go/repositories/changes"
+	"github.com/chechetech/app/azure-go/repositories/history"
+	"github.com/chechetech/app/azure-go/repositories/promotions"
+	"github.com/gin-gonic/gin"
+)
+
+// PromotionRequest names the deployment whose running image is promoted and
+// the environment it goes to. An empty Container means the first one.
+type PromotionRequest struct {
+	Deployment  string `json:"deployment" binding:"required"`
+	Container   string `json:"container"`
+	Environment string `json:"environment" binding:"required"`
+}
+
+func RegisterPromotionsRoutes(r *gin.Engine) {
+	r.POST("/promotions", func(c *gin.Context) {
+		clientset, ok := getClientset(c)
+		if !ok {
+			return
+		}
+
+		namespace, ok := getNamespace(c)
+		if !ok {
+			return
+		}
+
+		cfg, ok := getConfig(c)
+		if !ok {
+			return
+		}
+
+		changeManager, ok := getChanges(c)
+		if !ok {
+			return
+		}
+
+		var request PromotionRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		promotion, err := promotions.Plan(clientset, cfg, namespace, request.Deployment, request.Container, request.Environment)
+		if err != nil {
+			code := statusForError(err)
+			switch {
+			case errors.Is(err, promotions.ErrInvalid):
+				code = http.StatusBadRequest
+			case errors.Is(err, promotions.ErrNoDigest):
+				code = http.StatusConflict
+			}
+			c.JSON(code, gin.H{"error": fmt.Sprintf("Failed to plan promotion: %v", err)})
+			return
+		}
+
+		// The token only grants its own namespace, on both ends.
+		if promotion.Target.Namespace != namespace {
+			c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("target %s/%s is outside namespace %s", promotion.Target.Namespace, promotion.Target.Deployment, namespace), "promotion": promotion})
+			return
+		}
+
+		change, err := changeManager.Submit(changes.Change{
+			Action:     history.ActionPromotion,
+			Actor:      c.GetString("actor"),
+			Repository: promotion.TargetRepository,
+			Source:     promotion.Source.Namespace + "/" + promotion.Source.Deployment,
+			Namespace:  promotion.Target.Namespace,
+			Deployment: promotion.Target.Deployment,
+			Container:  promotion.Target.Container,
+			Image:      promotion.Image,
+			Tag:        promotion.Tag,
+			Digest:     promotion.Digest,
+		})
+		if err != nil {
+			c.JSON(statusForError(err), gin.H{"error": fmt.Sprintf("Failed to promote image: %v", err), "promotion": promotion, "change": change})
+			return
+		}
+
+		code := http.StatusOK
+		if change.Status != changes.StatusApplied {
+			code = http.StatusAccepted
+		}
+		c.JSON(code, gin.H{"promotion": promotion, "change": change})
+	})
+}
@@ -1,39 +1,18 @@
 package routes
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
-	"strings"
+	"strconv"
 
+	"github.com/chechetech/app/azure-go/repositories/deployments"
 	repo "github.com/chechetech/app/azure-go/repositories/registries"
+	"github.com/chechetech/app/azure-go/repositories/webhooks"
 	"github.com/gin-gonic/gin"
-	"k8s.io/client-go/kubernetes"
 )
 
-type WebhookTarget struct {
-	MediaType  string
-	Size       int32
-	Digest     string
-	Length     int32
-	Repository string
-	Tag        string
-}
-
-type WebhookRequest struct {
-	ID        string
-	Host      string
-	Method    string
-	UserAgent string
-}
-
-type Webhook struct {
-	ID        string
-	Timestamp string
-	Action    string
-	Target    WebhookTarget
-	Request   WebhookRequest
-}
-
 func RegisterRegistriesRoutes(router *gin.Engine) {
 	router.POST("/update-deployment", func(c *gin.Context) {
 
@@ -41,45 +20,280 @@ func RegisterRegistriesRoutes(router *gin.Engine) {
 		fmt.Printf("Request User-Agent: %s\n", c.Request.UserAgent())
 		fmt.Printf("Request Referer: %s\n", c.Request.Referer())
 
-		getClientset, exists := c.Get("clientset")
-		if !exists {
-			c.JSON(500, gin.H{"error": "clientset not found"})
+		cfg, ok := getConfig(c)
+		if !ok {
+			return
+		}
+
+		queue, ok := getWebhooks(c)
+		if !ok {
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
-		clientset := getClientset.(*kubernetes.Clientset)
 
-		var webhook Webhook
-		if err := c.ShouldBindJSON(&webhook); err != nil {
+		// The registry is detected from the payload unless the webhook URL
+		// names it, e.g. /update-deployment?source=harbor.
+		events, err := webhooks.Parse(c.Query("source"), c.Request.Header, body)
+		if err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
 
-		fmt.Println("Webhook Target Repository: ", webhook.Target.Repository)
-		parts := strings.SplitN(webhook.Target.Repository, "/", 3)
-		fmt.Println("Parts: ", parts)
+		// Harbor can report several artifacts in one payload; each becomes
+		// its own event.
+		var stored []webhooks.Event
+		var queued, rejected int
+		for _, event := range events {
+			fmt.Println("Webhook Target Repository: ", event.Repository)
+			event.Actor = c.GetString("actor")
+
+			// Routing only needs the config, so an event that can't be
+			// routed is rejected here and only stored for the record.
+			target, _, err := repo.ResolveTarget(cfg, event.Repository)
+			if err != nil {
+				event.Status, event.Reason = webhooks.StatusRejected, err.Error()
+			}
+			event.Namespace, event.Deployment, event.Container = target.Namespace, target.Deployment, target.Container
+
+			event, duplicate, err := queue.Enqueue(event)
+			if err != nil {
+				fmt.Printf("Error queueing event: %v\n", err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue event"})
+				return
+			}
+			stored = append(stored, event)
+
+			switch {
+			case duplicate:
+			case event.Status == webhooks.StatusRejected:
+				rejected++
+			default:
+				queued++
+			}
+		}
+
+		response := gin.H{"event": stored[0]}
+		if len(stored) > 1 {
+			response["events"] = stored
+		}
+
+		switch {
+		case len(stored) == 1 && rejected == 1:
+			response["error"] = stored[0].Reason
+			c.JSON(http.StatusBadRequest, response)
+		case queued == 0 && rejected == 0:
+			response["message"] = "Duplicate event ignored"
+			c.JSON(http.StatusOK, response)
+		default:
+			response["message"] = "Event queued"
+			c.JSON(http.StatusAccepted, response)
+		}
+	})
+
+	router.GET("/update-deployment/events", func(c *gin.Context) {
+		namespace, ok := getNamespace(c)
+		if !ok {
+			return
+		}
+
+		queue, ok := getWebhooks(c)
+		if !ok {
+			return
+		}
+
+		limit := 100
+		if limitStr := c.Query("limit"); limitStr != "" {
+			parsedLimit, err := strconv.Atoi(limitStr)
+			if err == nil && parsedLimit > 0 {
+				limit = parsedLimit
+			}
+		}
+
+		events, err := queue.List(namespace, limit)
+		if err != nil {
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to get events: %v", err)})
+			return
+		}
+
+		c.JSON(http.StatusOK, events)
+	})
+
+	router.GET("/update-deployment/events/:id", func(c *gin.Context) {
+		namespace, ok := getNamespace(c)
+		if !ok {
+			return
+		}
+
+		queue, ok := getWebhooks(c)
+		if !ok {
+			return
+		}
+
+		event, found, err := queue.Get(c.Param("id"))
+		if err != nil {
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to get event: %v", err)})
+			return
+		}
+		if !found || event.Namespace != namespace {
+			c.JSON(http.StatusNotFound, gin.H{"error": "event not found"})
+			return
+		}
+
+		c.JSON(http.StatusOK, event)
+	})
+
+	router.GET("/registries", func(c *gin.Context) {
+		cfg, ok := getConfig(c)
+		if !ok {
+			return
+		}
 
-		company := parts[0]
-		var namespace, deploymentName, imagePath string
+		registries := make([]gin.H, 0, len(cfg.Registries))
+		for _, registry := range cfg.Registries {
+			registries = append(registries, gin.H{"name": registry.Name, "host": registry.Host})
+		}
+
+		c.JSON(http.StatusOK, registries)
+	})
+
+	// Repositories and tags are only listed for the repositories that
+	// deploy to the token's namespace.
+	router.GET("/registries/:name/repositories", func(c *gin.Context) {
+		namespace, ok := getNamespace(c)
+		if !ok {
+			return
+		}
+
+		cfg, ok := getConfig(c)
+		if !ok {
+			return
+		}
 
-		if company == "cheche" {
-			namespace = company
-			deploymentName = strings.ReplaceAll(parts[1]+"/"+parts[2], "/", "-")
-			imagePath = fmt.Sprintf("%s/%s:%s", webhook.Request.Host, webhook.Target.Repository, webhook.Target.Tag)
-		} else {
-			namespace = parts[1]
-			deploymentName = strings.ReplaceAll(parts[2], "/", "-")
-			imagePath = fmt.Sprintf("%s/%s:%s", webhook.Request.Host, webhook.Target.Repository, webhook.Target.Tag)
+		registry := cfg.RegistryNamed(c.Param("name"))
+		if registry == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "registry not found"})
+			return
 		}
 
-		fmt.Println("Namespace: ", namespace, "Deployment Name: ", deploymentName, "Image Path: ", imagePath)
+		n := 100
+		if nStr := c.Query("n"); nStr != "" {
+			parsedN, err := strconv.Atoi(nStr)
+			if err == nil && parsedN > 0 {
+				n = parsedN
+			}
+		}
 
-		err := repo.UpdateDeploymentImage(clientset, namespace, deploymentName, imagePath)
+		// A page can come back shorter than n, or empty, with more after
+		// it, as next still follows the registry's own pages.
+		catalog, next, err := repo.NewClient(*registry).Catalog(c.Request.Context(), n, c.Query("last"))
 		if err != nil {
-			fmt.Printf("Error updating deployment: %v\n", err)
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update deployment"})
+			c.JSON(statusForRegistryError(err), gin.H{"error": fmt.Sprintf("Failed to list repositories: %v", err)})
 			return
 		}
+		repositories := []string{}
+		for _, repository := range catalog {
+			if target, _, err := repo.ResolveTarget(cfg, repository); err == nil && target.Namespace == namespace {
+				repositories = append(repositories, repository)
+			}
+		}
 
-		c.JSON(http.StatusOK, gin.H{"message": "Deployment updated successfully"})
+		c.JSON(http.StatusOK, gin.H{"repositories": repositories, "next": next})
 	})
+
+	// The repository is a query parameter because its name has slashes.
+	router.GET("/registries/:name/tags", func(c *gin.Context) {
+		clientset, ok := getClientset(c)
+		if !ok {
+			return
+		}
+
+		namespace, ok := getNamespace(c)
+		if !ok {
+			return
+		}
+
+		store, ok := getCache(c)
+		if !ok {
+			return
+		}
+
+		cfg, ok := getConfig(c)
+		if !ok {
+			return
+		}
+
+		registry := cfg.RegistryNamed(c.Param("name"))
+		if registry == nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "registry not found"})
+			return
+		}
+
+		repository := c.Query("repository")
+		if repository == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "repository is required"})
+			return
+		}
+		if target, _, err := repo.ResolveTarget(cfg, repository); err != nil || target.Namespace != namespace {
+			c.JSON(http.StatusNotFound, gin.H{"error": "repository not found"})
+			return
+		}
+
+		client := repo.NewClient(*registry)
+		tags, err := client.Tags(c.Request.Context(), repository)
+		if err != nil {
+			c.JSON(statusForRegistryError(err), gin.H{"error": fmt.Sprintf("Failed to list tags: %v", err)})
+			return
+		}
+
+		// Digests cost a request per tag, so they are only looked up when
+		// asked for.
+		withDigests, _ := strconv.ParseBool(c.Query("digests"))
+		infos := make([]repo.TagInfo, 0, len(tags))
+		for _, tag := range tags {
+			info := repo.TagInfo{Tag: tag}
+			if withDigests {
+				if info.Digest, err = client.Digest(c.Request.Context(), repository, tag); err != nil {
+					c.JSON(statusForRegistryError(err), gin.H{"error": fmt.Sprintf("Failed to get digest of %s: %v", tag, err)})
+					return
+				}
+			}
+			infos = append(infos, info)
+		}
+
+		deploymentList, err := deployments.GetDeployments(clientset, store, namespace)
+		if err != nil {
+			c.JSON(500, gin.H{"error": fmt.Sprintf("Failed to get deployments: %v", err)})
+			return
+		}
+
+		newest := repo.NewestTag(tags)
+		deployed := repo.DeployedImages(deploymentList.Items, registry.Host, repository)
+		repo.MatchTags(infos, deployed, newest)
+
+		c.JSON(http.StatusOK, gin.H{
+			"registry":    registry.Name,
+			"repository":  repository,
+			"newest":      newest,
+			"tags":        infos,
+			"deployments": deployed,
+		})
+	})
+}
+
+// statusForRegistryError keeps a 404 from the registry, rejects references
+// that were never sent and reports anything else as a bad gateway, since
+// the registry is what failed.
+func statusForRegistryError(err error) int {
+	switch {
+	case errors.Is(err, repo.ErrRepositoryNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, repo.ErrInvalidReference):
+		return http.StatusBadRequest
+	}
+	return http.StatusBadGateway
 }